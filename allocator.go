@@ -0,0 +1,94 @@
+package watchrelay
+
+import (
+	"context"
+	"errors"
+
+	"github.com/hunknownz/watchrelay/storage/generic"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RevisionAllocator allocates the revisions of log events. Allocate is called
+// inside the transaction writing the events; tx is nil for relays without a
+// database.
+type RevisionAllocator interface {
+	Allocate(ctx context.Context, tx *gorm.DB) (uint64, error)
+}
+
+// AllocatorFunc creates the RevisionAllocator of a relay once its event log
+// exists. table is the table of the event log and currentRev the newest
+// revision in the log.
+type AllocatorFunc func(db *gorm.DB, table string, currentRev uint64) (RevisionAllocator, error)
+
+// NewSequenceAllocator allocates revisions from an in-process Sequence. It is
+// the default allocator and is only correct with a single writer process.
+func NewSequenceAllocator(db *gorm.DB, table string, currentRev uint64) (RevisionAllocator, error) {
+	return NewSequence(currentRev), nil
+}
+
+// revisionSequence is the single row of the sequence table.
+type revisionSequence struct {
+	ID       int `gorm:"primaryKey;autoIncrement:false"`
+	Revision uint64
+}
+
+// sequenceTable is the sequence table of the watchrelay table, renamed
+// along with it.
+const sequenceTable = "watchrelay_sequence"
+
+// TableAllocator allocates revisions by incrementing a row of a dedicated
+// sequence table within the writing transaction. The row stays locked until
+// the transaction ends, so writers in any number of processes get unique
+// revisions that commit in the order they were allocated, at the cost of
+// serializing the writes.
+type TableAllocator struct {
+	table string
+}
+
+// NewTableAllocator creates the sequence table of the event log in table if
+// needed and makes sure it does not lag behind currentRev.
+func NewTableAllocator(db *gorm.DB, table string, currentRev uint64) (RevisionAllocator, error) {
+	if db == nil {
+		return nil, errors.New("watchrelay: table allocator requires a database")
+	}
+
+	a := &TableAllocator{table: generic.Table(sequenceTable, table)}
+	if err := db.Table(a.table).AutoMigrate(&revisionSequence{}); err != nil {
+		return nil, err
+	}
+
+	seq := &revisionSequence{ID: 1, Revision: currentRev}
+	if err := db.Table(a.table).Clauses(clause.OnConflict{DoNothing: true}).Create(seq).Error; err != nil {
+		return nil, err
+	}
+	err := db.Table(a.table).
+		Where("id = ? AND revision < ?", 1, currentRev).
+		Update("revision", currentRev).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *TableAllocator) Allocate(ctx context.Context, tx *gorm.DB) (uint64, error) {
+	if tx == nil {
+		return 0, errors.New("watchrelay: table allocator requires a database")
+	}
+
+	err := tx.Table(a.table).
+		Where("id = ?", 1).
+		Update("revision", gorm.Expr("revision + ?", 1)).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var rev uint64
+	err = tx.Table(a.table).
+		Select("revision").
+		Where("id = ?", 1).
+		Scan(&rev).Error
+	return rev, err
+}
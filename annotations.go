@@ -0,0 +1,74 @@
+package watchrelay
+
+import (
+	"context"
+
+	"github.com/hunknownz/watchrelay/event"
+	"github.com/hunknownz/watchrelay/resource"
+)
+
+// Well-known annotations of events.
+const (
+	// AnnotationActor is who made a change, e.g. a user name.
+	AnnotationActor = "watchrelay/actor"
+	// AnnotationReason is why a change was made, e.g. the request making it.
+	AnnotationReason = "watchrelay/reason"
+)
+
+type annotationsKey struct{}
+
+// ContextWithAnnotations returns a copy of ctx annotating the events written
+// with it by Create, Update, Patch and Delete. Annotations already carried by
+// ctx are kept unless overridden.
+func ContextWithAnnotations(ctx context.Context, annotations map[string]string) context.Context {
+	parent := AnnotationsFromContext(ctx)
+	merged := make(map[string]string, len(parent)+len(annotations))
+	for k, v := range parent {
+		merged[k] = v
+	}
+	for k, v := range annotations {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, annotationsKey{}, merged)
+}
+
+// ContextWithActor annotates the events written with ctx with their actor.
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return ContextWithAnnotations(ctx, map[string]string{AnnotationActor: actor})
+}
+
+// ContextWithReason annotates the events written with ctx with their reason.
+func ContextWithReason(ctx context.Context, reason string) context.Context {
+	return ContextWithAnnotations(ctx, map[string]string{AnnotationReason: reason})
+}
+
+// AnnotationsFromContext returns the annotations carried by ctx. The map must
+// not be modified.
+func AnnotationsFromContext(ctx context.Context) map[string]string {
+	annotations, _ := ctx.Value(annotationsKey{}).(map[string]string)
+	return annotations
+}
+
+// selectAnnotated returns the events having all the annotations of selector.
+func selectAnnotated[T resource.IVersionedResource](events []*event.Event[T], selector map[string]string) []*event.Event[T] {
+	if len(selector) == 0 {
+		return events
+	}
+
+	selected := make([]*event.Event[T], 0, len(events))
+	for _, e := range events {
+		if hasAnnotations(e.Annotations, selector) {
+			selected = append(selected, e)
+		}
+	}
+	return selected
+}
+
+func hasAnnotations(annotations, selector map[string]string) bool {
+	for k, v := range selector {
+		if value, ok := annotations[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package watchrelay_test
+
+import (
+	"context"
+	"testing"
+
+	wr "github.com/hunknownz/watchrelay"
+	"github.com/hunknownz/watchrelay/event"
+)
+
+func TestContextWithAnnotations(t *testing.T) {
+	ctx := wr.ContextWithActor(context.Background(), "alice")
+	ctx = wr.ContextWithReason(ctx, "rollout")
+	ctx = wr.ContextWithAnnotations(ctx, map[string]string{"x-request-id": "42", wr.AnnotationActor: "bob"})
+
+	got := wr.AnnotationsFromContext(ctx)
+	want := map[string]string{wr.AnnotationActor: "bob", wr.AnnotationReason: "rollout", "x-request-id": "42"}
+	if len(got) != len(want) {
+		t.Fatalf("annotations %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("annotation %s = %q, want %q", k, got[k], v)
+		}
+	}
+	if a := wr.AnnotationsFromContext(context.Background()); len(a) != 0 {
+		t.Errorf("annotations of a bare context %v, want none", a)
+	}
+}
+
+func TestMemoryWatchAnnotations(t *testing.T) {
+	w := newMemoryRelay(t)
+
+	wt := wr.Watch[*Task](w, context.Background(), nil, 0)
+	defer wt.Stop()
+
+	ctx := wr.ContextWithActor(context.Background(), "alice")
+	ctx = wr.ContextWithReason(ctx, "rollout")
+	ctx = wr.ContextWithAnnotations(ctx, map[string]string{"x-request-id": "42"})
+	a := &Task{Name: "a"}
+	if err := wr.Create[*Task](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := wr.Delete[*Task](w, wr.ContextWithActor(context.Background(), "bob"), nil, nil, a); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	events := receive(t, wt, 2)
+	want := []map[string]string{
+		{wr.AnnotationActor: "alice", wr.AnnotationReason: "rollout", "x-request-id": "42"},
+		{wr.AnnotationActor: "bob"},
+	}
+	for i, e := range events {
+		if len(e.Annotations) != len(want[i]) {
+			t.Errorf("event %d: annotations %v, want %v", i, e.Annotations, want[i])
+			continue
+		}
+		for k, v := range want[i] {
+			if e.Annotations[k] != v {
+				t.Errorf("event %d: annotation %s = %q, want %q", i, k, e.Annotations[k], v)
+			}
+		}
+	}
+}
+
+func TestMemoryWatchAnnotationSelector(t *testing.T) {
+	w := newMemoryRelay(t)
+	ctx := context.Background()
+
+	wt := wr.Watch[*Task](w, ctx, nil, 0, wr.WithAnnotationSelector(map[string]string{
+		wr.AnnotationActor:  "alice",
+		wr.AnnotationReason: "rollout",
+	}))
+	defer wt.Stop()
+
+	alice := wr.ContextWithActor(ctx, "alice")
+	writes := []struct {
+		ctx  context.Context
+		name string
+	}{
+		{ctx, "unannotated"},
+		{alice, "no reason"},
+		{wr.ContextWithReason(alice, "rollout"), "selected"},
+		{wr.ContextWithReason(wr.ContextWithActor(ctx, "bob"), "rollout"), "other actor"},
+		{wr.ContextWithAnnotations(wr.ContextWithReason(alice, "rollout"), map[string]string{"x-request-id": "42"}), "selected too"},
+	}
+	for _, write := range writes {
+		if err := wr.Create[*Task](w, write.ctx, nil, nil, &Task{Name: write.name}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	checkEvents(t, receive(t, wt, 2), []wantEvent{
+		{event.EventActionCreate, 3, 3, 0, "selected"},
+		{event.EventActionCreate, 5, 5, 0, "selected too"},
+	})
+}
+
+func TestSQLiteAnnotations(t *testing.T) {
+	db, w := newSQLiteRelay(t)
+
+	ctx := wr.ContextWithAnnotations(wr.ContextWithActor(context.Background(), "alice"), map[string]string{"x-request-id": "42"})
+	if err := db.WithContext(ctx).Create(&Item{Name: "a"}).Error; err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	_, events, err := wr.After[*Item](w, context.Background(), nil, 0, 0)
+	if err != nil {
+		t.Fatalf("After: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("logged %d events, want 1", len(events))
+	}
+	if a := events[0].Annotations; len(a) != 2 || a[wr.AnnotationActor] != "alice" || a["x-request-id"] != "42" {
+		t.Errorf("annotations %v, want the actor alice and x-request-id 42", a)
+	}
+}
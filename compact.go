@@ -0,0 +1,32 @@
+package watchrelay
+
+import (
+	"context"
+	"time"
+
+	"github.com/hunknownz/watchrelay/logging"
+)
+
+// compact periodically compacts the event log until ctx is done.
+func (w *WatchRelay) compact(ctx context.Context) {
+	ticker := time.NewTicker(w.opts.compactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := w.dialect.ClearExpiredEvents(ctx, w.opts.compactRetention)
+		if err != nil {
+			w.opts.log.Logger.Error("watchrelay: failed to compact events", logging.KeyError, err)
+			continue
+		}
+		w.opts.log.Metrics.CompactionDeleted(n)
+		if n > 0 {
+			w.opts.log.Logger.Debug("watchrelay: compacted events", "deleted", n)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package watchrelay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/hunknownz/watchrelay/resource"
+
+	"gorm.io/gorm"
+)
+
+// conflict returns the error for a write of res from prevRev that matched no
+// row: ErrNotFound if res does not exist, a *ConflictError otherwise.
+func conflict[T resource.IVersionedResource](tx *gorm.DB, res T, prevRev uint64) error {
+	current, err := load(tx, res)
+	if err != nil {
+		return err
+	}
+	return &ConflictError{Revision: prevRev, CurrentRevision: current.GetResourceVersion()}
+}
+
+// load reads the stored row of res, addressed by its primary key, into a copy of res.
+func load[T resource.IVersionedResource](tx *gorm.DB, res T) (T, error) {
+	v := reflect.ValueOf(res)
+	if v.Kind() != reflect.Pointer {
+		var zero T
+		return zero, fmt.Errorf("watchrelay: resource %T is not a pointer", res)
+	}
+
+	current := reflect.New(v.Type().Elem())
+	current.Elem().Set(v.Elem())
+	err := tx.Take(current.Interface()).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = ErrNotFound
+	}
+	return current.Interface().(T), err
+}
+
+// reload replaces res with its current state.
+func reload[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, res T, currentRev uint64) error {
+	if w.db != nil {
+		current, err := load(w.db.WithContext(ctx), res)
+		if err != nil {
+			return err
+		}
+		reflect.ValueOf(res).Elem().Set(reflect.ValueOf(current).Elem())
+		return nil
+	}
+
+	events, err := w.store.Get(ctx, currentRev)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 || events[0].Deleted {
+		return ErrNotFound
+	}
+	return json.Unmarshal(events[0].Value, res)
+}
+
+// UpdateFunc applies a change to a resource.
+type UpdateFunc[T resource.IVersionedResource] func(res T) error
+
+// GuaranteedUpdate applies tryUpdate to res and updates it. If res has been
+// changed concurrently, res is replaced with its current state and tryUpdate
+// is applied again, until the update succeeds, tryUpdate fails or ctx is done.
+func GuaranteedUpdate[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, beforeUpdate, afterUpdate Hook[T], res T, tryUpdate UpdateFunc[T]) error {
+	if w == nil {
+		return errors.New("watchrelay: WatchRelay is nil")
+	}
+
+	for {
+		if err := tryUpdate(res); err != nil {
+			return err
+		}
+
+		err := Update(w, ctx, beforeUpdate, afterUpdate, res)
+		var conflictErr *ConflictError
+		if !errors.As(err, &conflictErr) {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := reload(w, ctx, res, conflictErr.CurrentRevision); err != nil {
+			return err
+		}
+	}
+}
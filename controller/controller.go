@@ -0,0 +1,214 @@
+// Package controller runs reconcile loops over the resources of a WatchRelay.
+package controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hunknownz/watchrelay"
+	"github.com/hunknownz/watchrelay/informer"
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/resource"
+)
+
+const (
+	defaultWorkers     = 1
+	defaultMaxRetries  = 15
+	defaultBaseBackoff = 5 * time.Millisecond
+	defaultMaxBackoff  = 1000 * time.Second
+)
+
+// Result tells the controller what to do with a key reconciled successfully.
+type Result struct {
+	// RequeueAfter reconciles the key again after the duration, if positive.
+	RequeueAfter time.Duration
+}
+
+// ReconcileFunc brings the state of the resource with the given key to the
+// desired state. Keys failing to reconcile are retried with backoff.
+type ReconcileFunc func(ctx context.Context, key string) (Result, error)
+
+type options struct {
+	workers      int
+	maxRetries   int
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+	resyncPeriod time.Duration
+}
+
+// Option configures a Controller.
+type Option func(*options)
+
+func newOptions(opts []Option) options {
+	o := options{
+		workers:     defaultWorkers,
+		maxRetries:  defaultMaxRetries,
+		baseBackoff: defaultBaseBackoff,
+		maxBackoff:  defaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithWorkers sets the number of keys reconciled concurrently, at least 1.
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		if n < 1 {
+			n = 1
+		}
+		o.workers = n
+	}
+}
+
+// WithMaxRetries sets how many times a failing key is retried before it is
+// dropped. A negative value retries forever.
+func WithMaxRetries(n int) Option {
+	return func(o *options) {
+		o.maxRetries = n
+	}
+}
+
+// WithBackoff sets the delay before the first retry of a failing key, doubled
+// on every retry up to max.
+func WithBackoff(base, max time.Duration) Option {
+	return func(o *options) {
+		o.baseBackoff = base
+		o.maxBackoff = max
+	}
+}
+
+// WithResyncPeriod reconciles every resource again every period.
+func WithResyncPeriod(period time.Duration) Option {
+	return func(o *options) {
+		o.resyncPeriod = period
+	}
+}
+
+// Controller reconciles the resources of type T whenever they change. Keys
+// are the resource keys of the resources.
+type Controller[T resource.IKeyedResource] struct {
+	w         *watchrelay.WatchRelay
+	log       logging.Logger
+	informer  *informer.Informer[T]
+	queue     *Queue
+	reconcile ReconcileFunc
+	opts      options
+}
+
+func New[T resource.IKeyedResource](w *watchrelay.WatchRelay, reconcile ReconcileFunc, opts ...Option) *Controller[T] {
+	o := newOptions(opts)
+	var v T
+	c := &Controller[T]{
+		w:         w,
+		log:       w.Logger().With(logging.KeyResource, resource.GetResourceName(v)),
+		informer:  informer.New[T](w, o.resyncPeriod, nil),
+		queue:     NewQueue(NewExponentialRateLimiter(o.baseBackoff, o.maxBackoff)),
+		reconcile: reconcile,
+		opts:      o,
+	}
+	c.informer.AddEventHandler(informer.EventHandlerFuncs[T]{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(_, obj T) { c.enqueue(obj) },
+		DeleteFunc: c.enqueue,
+	})
+	return c
+}
+
+// Lister returns a Lister of the resources seen by the controller.
+func (c *Controller[T]) Lister() informer.Lister[T] {
+	return c.informer.Lister()
+}
+
+// Queue returns the work queue of the controller, e.g. to enqueue keys.
+func (c *Controller[T]) Queue() *Queue {
+	return c.queue
+}
+
+// Run reconciles resources until ctx or the context the relay was started
+// with is done. It then stops handing out keys and waits for the reconciles
+// in progress to return.
+func (c *Controller[T]) Run(ctx context.Context) error {
+	if c.reconcile == nil {
+		return errors.New("watchrelay: ReconcileFunc is nil")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.w.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	go c.informer.Run(ctx)
+	if !c.waitForSync(ctx) {
+		c.queue.ShutDown()
+		return ctx.Err()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < c.opts.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c.processNext(ctx) {
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	c.queue.ShutDown()
+	wg.Wait()
+	return nil
+}
+
+func (c *Controller[T]) waitForSync(ctx context.Context) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !c.informer.HasSynced() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+func (c *Controller[T]) enqueue(obj T) {
+	c.queue.Add(obj.GetResourceKey())
+}
+
+// processNext reconciles the next key, returning false once the queue is shut down.
+func (c *Controller[T]) processNext(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	result, err := c.reconcile(ctx, key)
+	switch {
+	case err != nil:
+		if c.opts.maxRetries >= 0 && c.queue.NumRequeues(key) >= c.opts.maxRetries {
+			c.log.WithContext(ctx).Error("watchrelay: dropping key after retries", "key", key, "retries", c.queue.NumRequeues(key), logging.KeyError, err)
+			c.queue.Forget(key)
+			return true
+		}
+		c.log.WithContext(ctx).Debug("watchrelay: failed to reconcile, retrying", "key", key, logging.KeyError, err)
+		c.queue.AddRateLimited(key)
+	case result.RequeueAfter > 0:
+		c.queue.Forget(key)
+		c.queue.AddAfter(key, result.RequeueAfter)
+	default:
+		c.queue.Forget(key)
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hunknownz/watchrelay"
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/resource"
+	"github.com/hunknownz/watchrelay/storage/memory"
+)
+
+type Task struct {
+	resource.Meta
+	Name string
+}
+
+func (t *Task) GetResourceKey() string {
+	return t.Name
+}
+
+func TestWithWorkers(t *testing.T) {
+	tests := []struct {
+		n, want int
+	}{
+		{-1, 1},
+		{0, 1},
+		{1, 1},
+		{4, 4},
+	}
+	for _, tt := range tests {
+		if got := newOptions([]Option{WithWorkers(tt.n)}).workers; got != tt.want {
+			t.Errorf("WithWorkers(%d) runs %d workers, want %d", tt.n, got, tt.want)
+		}
+	}
+	if got := newOptions(nil).workers; got != defaultWorkers {
+		t.Errorf("runs %d workers by default, want %d", got, defaultWorkers)
+	}
+}
+
+func TestControllerRetries(t *testing.T) {
+	w, err := watchrelay.NewWatchRelayWithStore(memory.New(), watchrelay.WithPollInterval(10*time.Millisecond), watchrelay.WithLogger(logging.Discard()))
+	if err != nil {
+		t.Fatalf("NewWatchRelayWithStore: %v", err)
+	}
+	if err := watchrelay.RegisterResource[*Task](w); err != nil {
+		t.Fatalf("RegisterResource: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.Start(ctx)
+
+	// ok succeeds at once, flaky on its third attempt and broken never.
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	reconcile := func(ctx context.Context, key string) (Result, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[key]++
+		if key == "broken" || key == "flaky" && attempts[key] < 3 {
+			return Result{}, errors.New("not ready")
+		}
+		return Result{}, nil
+	}
+	c := New[*Task](w, reconcile, WithMaxRetries(2), WithBackoff(time.Millisecond, 10*time.Millisecond), WithWorkers(2))
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+
+	if err := watchrelay.Create[*Task](w, ctx, nil, nil, &Task{Name: "ok"}, &Task{Name: "flaky"}, &Task{Name: "broken"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// Keys are dropped after the initial attempt and 2 retries.
+	want := map[string]int{"ok": 1, "flaky": 3, "broken": 3}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		got := make(map[string]int)
+		for k, v := range attempts {
+			got[k] = v
+		}
+		mu.Unlock()
+		if got["ok"] == want["ok"] && got["flaky"] == want["flaky"] && got["broken"] == want["broken"] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("reconciled %v times, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if attempts["broken"] != want["broken"] {
+		t.Errorf("reconciled broken %d times, want %d", attempts["broken"], want["broken"])
+	}
+	mu.Unlock()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run still running after ctx is done")
+	}
+}
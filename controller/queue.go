@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter decides how long an item waits before being retried.
+type RateLimiter interface {
+	// When returns the delay before the next retry of key, counting it.
+	When(key string) time.Duration
+	// Forget resets the retries of key.
+	Forget(key string)
+	// NumRequeues returns the number of retries of key since it was forgotten.
+	NumRequeues(key string) int
+}
+
+// ExponentialRateLimiter doubles the delay of an item on every retry, from
+// base up to max.
+type ExponentialRateLimiter struct {
+	mu       sync.Mutex
+	failures map[string]int
+	base     time.Duration
+	max      time.Duration
+}
+
+func NewExponentialRateLimiter(base, max time.Duration) *ExponentialRateLimiter {
+	return &ExponentialRateLimiter{
+		failures: make(map[string]int),
+		base:     base,
+		max:      max,
+	}
+}
+
+func (r *ExponentialRateLimiter) When(key string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	exp := r.failures[key]
+	r.failures[key]++
+
+	delay := float64(r.base) * math.Pow(2, float64(exp))
+	if delay > float64(r.max) {
+		return r.max
+	}
+	return time.Duration(delay)
+}
+
+func (r *ExponentialRateLimiter) Forget(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.failures, key)
+}
+
+func (r *ExponentialRateLimiter) NumRequeues(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failures[key]
+}
+
+// Queue is a work queue of keys. A key is queued at most once however often it
+// is added, and is never handed to two workers at the same time: a key added
+// while being processed is queued again once it is done.
+type Queue struct {
+	limiter RateLimiter
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	queue        []string
+	dirty        map[string]struct{}
+	processing   map[string]struct{}
+	shuttingDown bool
+}
+
+func NewQueue(limiter RateLimiter) *Queue {
+	q := &Queue{
+		limiter:    limiter,
+		dirty:      make(map[string]struct{}),
+		processing: make(map[string]struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Add queues key unless it is already queued.
+func (q *Queue) Add(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.shuttingDown {
+		return
+	}
+	if _, ok := q.dirty[key]; ok {
+		return
+	}
+	q.dirty[key] = struct{}{}
+	if _, ok := q.processing[key]; ok {
+		return
+	}
+	q.queue = append(q.queue, key)
+	q.cond.Signal()
+}
+
+// AddAfter queues key once delay has passed.
+func (q *Queue) AddAfter(key string, delay time.Duration) {
+	if delay <= 0 {
+		q.Add(key)
+		return
+	}
+	time.AfterFunc(delay, func() { q.Add(key) })
+}
+
+// AddRateLimited queues key after the delay given by the rate limiter.
+func (q *Queue) AddRateLimited(key string) {
+	q.AddAfter(key, q.limiter.When(key))
+}
+
+// Forget resets the retries of key, e.g. once it has been processed successfully.
+func (q *Queue) Forget(key string) {
+	q.limiter.Forget(key)
+}
+
+// NumRequeues returns the number of rate limited retries of key.
+func (q *Queue) NumRequeues(key string) int {
+	return q.limiter.NumRequeues(key)
+}
+
+// Get blocks until a key can be processed. The key must be passed to Done
+// once processed. shutdown is true once the queue is shut down.
+func (q *Queue) Get() (key string, shutdown bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.queue) == 0 && !q.shuttingDown {
+		q.cond.Wait()
+	}
+	if q.shuttingDown {
+		return "", true
+	}
+
+	key, q.queue = q.queue[0], q.queue[1:]
+	q.processing[key] = struct{}{}
+	delete(q.dirty, key)
+	return key, false
+}
+
+// Done marks key as processed, queueing it again if it was added meanwhile.
+func (q *Queue) Done(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.processing, key)
+	if _, ok := q.dirty[key]; ok {
+		q.queue = append(q.queue, key)
+		q.cond.Signal()
+	}
+}
+
+// Len returns the number of queued keys.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.queue)
+}
+
+// ShutDown stops handing out keys and makes Get return. Keys still queued are
+// dropped.
+func (q *Queue) ShutDown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
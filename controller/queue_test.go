@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+// get gets the next key of q, failing if none is queued.
+func get(t *testing.T, q *Queue) string {
+	t.Helper()
+
+	if q.Len() == 0 {
+		t.Fatal("Get on an empty queue")
+	}
+	key, shutdown := q.Get()
+	if shutdown {
+		t.Fatal("Get returned shutdown")
+	}
+	return key
+}
+
+func TestQueueDedup(t *testing.T) {
+	q := NewQueue(NewExponentialRateLimiter(time.Millisecond, time.Second))
+
+	q.Add("a")
+	q.Add("b")
+	q.Add("a")
+	if n := q.Len(); n != 2 {
+		t.Fatalf("Len = %d, want 2", n)
+	}
+	if key := get(t, q); key != "a" {
+		t.Errorf("Get = %q, want a", key)
+	}
+	if key := get(t, q); key != "b" {
+		t.Errorf("Get = %q, want b", key)
+	}
+	if n := q.Len(); n != 0 {
+		t.Errorf("Len = %d, want 0", n)
+	}
+}
+
+func TestQueueProcessing(t *testing.T) {
+	q := NewQueue(NewExponentialRateLimiter(time.Millisecond, time.Second))
+
+	q.Add("a")
+	key := get(t, q)
+
+	// A key added while processed waits for it to be done, once however
+	// often it is added.
+	q.Add("a")
+	q.Add("a")
+	if n := q.Len(); n != 0 {
+		t.Fatalf("Len = %d while processing, want 0", n)
+	}
+	q.Done(key)
+	if n := q.Len(); n != 1 {
+		t.Fatalf("Len = %d once done, want 1", n)
+	}
+
+	// A key done without being added again is not queued.
+	q.Done(get(t, q))
+	if n := q.Len(); n != 0 {
+		t.Errorf("Len = %d, want 0", n)
+	}
+}
+
+func TestQueueShutDown(t *testing.T) {
+	q := NewQueue(NewExponentialRateLimiter(time.Millisecond, time.Second))
+
+	done := make(chan bool)
+	go func() {
+		_, shutdown := q.Get()
+		done <- shutdown
+	}()
+	q.ShutDown()
+	select {
+	case shutdown := <-done:
+		if !shutdown {
+			t.Error("Get did not return shutdown")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get still blocked after ShutDown")
+	}
+
+	q.Add("a")
+	if n := q.Len(); n != 0 {
+		t.Errorf("Len = %d after ShutDown, want 0", n)
+	}
+}
+
+func TestQueueAddRateLimited(t *testing.T) {
+	q := NewQueue(NewExponentialRateLimiter(10*time.Millisecond, time.Second))
+
+	q.AddRateLimited("a")
+	if n := q.Len(); n != 0 {
+		t.Fatalf("Len = %d before the delay, want 0", n)
+	}
+	if n := q.NumRequeues("a"); n != 1 {
+		t.Errorf("NumRequeues = %d, want 1", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("key not queued after the delay")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q.Forget("a")
+	if n := q.NumRequeues("a"); n != 0 {
+		t.Errorf("NumRequeues = %d once forgotten, want 0", n)
+	}
+}
+
+func TestExponentialRateLimiter(t *testing.T) {
+	r := NewExponentialRateLimiter(5*time.Millisecond, 30*time.Millisecond)
+
+	want := []time.Duration{5, 10, 20, 30, 30}
+	for i, w := range want {
+		if d := r.When("a"); d != w*time.Millisecond {
+			t.Errorf("retry %d: When = %v, want %v", i, d, w*time.Millisecond)
+		}
+	}
+	if n := r.NumRequeues("a"); n != len(want) {
+		t.Errorf("NumRequeues = %d, want %d", n, len(want))
+	}
+
+	// Keys back off independently.
+	if d := r.When("b"); d != 5*time.Millisecond {
+		t.Errorf("When of another key = %v, want 5ms", d)
+	}
+
+	r.Forget("a")
+	if n := r.NumRequeues("a"); n != 0 {
+		t.Errorf("NumRequeues = %d once forgotten, want 0", n)
+	}
+	if d := r.When("a"); d != 5*time.Millisecond {
+		t.Errorf("When once forgotten = %v, want 5ms", d)
+	}
+}
+
+func TestExponentialRateLimiterOverflow(t *testing.T) {
+	r := NewExponentialRateLimiter(time.Millisecond, time.Hour)
+
+	// The delay stays at max however many retries overflow it.
+	for i := 0; i < 100; i++ {
+		r.When("a")
+	}
+	if d := r.When("a"); d != time.Hour {
+		t.Errorf("When = %v, want 1h", d)
+	}
+}
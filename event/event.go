@@ -1,9 +1,11 @@
 package event
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/hunknownz/watchrelay/resource"
+	"github.com/hunknownz/watchrelay/tracing"
 
 	"gorm.io/datatypes"
 )
@@ -17,6 +19,20 @@ const (
 	EventActionGap // Gap is a placeholder for a missing event.
 )
 
+func (a EventAction) String() string {
+	switch a {
+	case EventActionCreate:
+		return "create"
+	case EventActionUpdate:
+		return "update"
+	case EventActionDelete:
+		return "delete"
+	case EventActionGap:
+		return "gap"
+	}
+	return "unknown"
+}
+
 type LogEvent struct {
 	Revision       uint64 `gorm:"primary_key"`
 	CreateRevision uint64
@@ -26,12 +42,30 @@ type LogEvent struct {
 	Deleted        bool
 	Value          datatypes.JSON
 	CreatedAt      time.Time
+	// TraceContext is the trace context of the writer of the event, encoded
+	// as a JSON object.
+	TraceContext datatypes.JSON
+	// Annotations are the annotations of the event, encoded as a JSON object.
+	Annotations datatypes.JSON
 }
 
 func (e *LogEvent) TableName() string {
 	return "watchrelay"
 }
 
+// Action returns the action recorded by the event.
+func (e *LogEvent) Action() EventAction {
+	switch {
+	case e.Created && e.Deleted:
+		return EventActionGap
+	case e.Created:
+		return EventActionCreate
+	case e.Deleted:
+		return EventActionDelete
+	}
+	return EventActionUpdate
+}
+
 type IEvent interface {
 	IsGap() bool
 	GetValue() any
@@ -45,10 +79,39 @@ type IEvent interface {
 type Event[T resource.IVersionedResource] struct {
 	CreateRevision uint64
 	Revision       uint64
+	PrevRevision   uint64
 	ResourceName   string
 	Action         EventAction
 	Value          T
-	CreatedAt      time.Time
+	// PrevValue is the value of the resource at PrevRevision. It is only set
+	// on events of watches requesting it, and when the previous event has not
+	// been compacted.
+	PrevValue T
+	CreatedAt time.Time
+	// TraceContext is the trace context of the writer of the event, for
+	// consumers to start spans linked to it. It is empty if the writer was not
+	// traced.
+	TraceContext tracing.MapCarrier
+	// Annotations describe the change, e.g. who made it and why. They are set
+	// by the writer of the event.
+	Annotations map[string]string
+
+	prevValue []byte
+}
+
+// WithPrevValue returns a copy of the event with PrevValue set.
+func (e *Event[T]) WithPrevValue() (*Event[T], error) {
+	withPrev := *e
+	if len(e.prevValue) == 0 {
+		return &withPrev, nil
+	}
+
+	t := new(T)
+	if err := json.Unmarshal(e.prevValue, t); err != nil {
+		return nil, err
+	}
+	withPrev.PrevValue = *t
+	return &withPrev, nil
 }
 
 func (e *Event[T]) IsGap() bool {
@@ -79,4 +142,75 @@ func (e *Event[T]) GetValue() any {
 	return e.Value
 }
 
-type EventFunc func(rv, createRv uint64, action EventAction, createdAt time.Time, v []byte) (IEvent, error)
+type EventFunc func(rv, createRv, prevRv uint64, action EventAction, createdAt time.Time, v, prevV, traceContext, annotations []byte) (IEvent, error)
+
+// NewEventFunc returns the EventFunc decoding the events of T.
+func NewEventFunc[T resource.IVersionedResource](resourceName string) EventFunc {
+	return func(rv, createRv, prevRv uint64, action EventAction, createdAt time.Time, v, prevV, traceContext, annotations []byte) (IEvent, error) {
+		t := new(T)
+		err := json.Unmarshal(v, t)
+		if err != nil {
+			return nil, err
+		}
+		var carrier tracing.MapCarrier
+		if len(traceContext) > 0 {
+			if err := json.Unmarshal(traceContext, &carrier); err != nil {
+				return nil, err
+			}
+		}
+		var annotationMap map[string]string
+		if len(annotations) > 0 {
+			if err := json.Unmarshal(annotations, &annotationMap); err != nil {
+				return nil, err
+			}
+		}
+		return &Event[T]{
+			Value:          *t,
+			CreateRevision: createRv,
+			Revision:       rv,
+			PrevRevision:   prevRv,
+			Action:         action,
+			ResourceName:   resourceName,
+			CreatedAt:      createdAt,
+			TraceContext:   carrier,
+			Annotations:    annotationMap,
+			prevValue:      prevV,
+		}, nil
+	}
+}
+
+// Gap is the event of a revision that carries nothing to deliver: a gap marker
+// filling a revision that was never committed, or an event that cannot be
+// decoded, e.g. of a resource not registered with the relay.
+type Gap struct {
+	Revision  uint64
+	CreatedAt time.Time
+}
+
+func (g *Gap) IsGap() bool {
+	return true
+}
+
+func (g *Gap) GetResourceName() string {
+	return ""
+}
+
+func (g *Gap) GetAction() EventAction {
+	return EventActionGap
+}
+
+func (g *Gap) GetRevision() uint64 {
+	return g.Revision
+}
+
+func (g *Gap) GetCreateRevision() uint64 {
+	return g.Revision
+}
+
+func (g *Gap) GetCreatedAt() time.Time {
+	return g.CreatedAt
+}
+
+func (g *Gap) GetValue() any {
+	return nil
+}
@@ -42,11 +42,16 @@ func consumeTask(w *wr.WatchRelay) {
 
 	r := wr.Watch[*Task](w, context.Background(), nil, 0)
 
-	for events := range r.Events {
+	defer r.Stop()
+
+	for events := range r.ResultChan() {
 		for _, event := range events {
 			fmt.Printf("task: %+v\n", event.Value)
 		}
 	}
+	if err := r.Err(); err != nil {
+		logrus.Errorf("wr.Watch %s", err)
+	}
 }
 
 func initDatabase() (*gorm.DB, error) {
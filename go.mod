@@ -1,16 +1,19 @@
 module github.com/hunknownz/watchrelay
 
-go 1.20
+go 1.21
 
-require gorm.io/datatypes v1.2.0
-
-require golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+require (
+	github.com/go-sql-driver/mysql v1.7.0
+	github.com/mattn/go-sqlite3 v1.14.15
+	github.com/sirupsen/logrus v1.9.3
+	gorm.io/datatypes v1.2.0
+	gorm.io/driver/mysql v1.4.7
+	gorm.io/driver/sqlite v1.4.3
+	gorm.io/gorm v1.24.7-0.20230306060331-85eaf9eeda11
+)
 
 require (
-	github.com/go-sql-driver/mysql v1.7.0 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
-	github.com/sirupsen/logrus v1.9.3
-	gorm.io/driver/mysql v1.4.7 // indirect
-	gorm.io/gorm v1.24.7-0.20230306060331-85eaf9eeda11 // indirect
+	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
 )
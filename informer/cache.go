@@ -0,0 +1,164 @@
+package informer
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hunknownz/watchrelay"
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/resource"
+)
+
+// IndexFunc returns the values an object is indexed under.
+type IndexFunc[T resource.IKeyedResource] func(obj T) ([]string, error)
+
+// Indexers maps index names to the functions computing them.
+type Indexers[T resource.IKeyedResource] map[string]IndexFunc[T]
+
+// Lister reads the objects cached by an informer.
+type Lister[T resource.IKeyedResource] interface {
+	// Get returns the object with the given key, or watchrelay.ErrNotFound.
+	Get(key string) (T, error)
+	// List returns all the cached objects.
+	List() []T
+	// ByIndex returns the objects indexed under indexedValue by the named index.
+	ByIndex(indexName, indexedValue string) ([]T, error)
+}
+
+// cache is a thread safe store of objects by key, maintaining indices.
+type cache[T resource.IKeyedResource] struct {
+	mu       sync.RWMutex
+	log      logging.Logger
+	items    map[string]T
+	indexers Indexers[T]
+	// indices maps an index name to indexed values to keys.
+	indices map[string]map[string]map[string]struct{}
+}
+
+func newCache[T resource.IKeyedResource](indexers Indexers[T], log logging.Logger) *cache[T] {
+	c := &cache[T]{
+		log:      log,
+		items:    make(map[string]T),
+		indexers: make(Indexers[T], len(indexers)),
+		indices:  make(map[string]map[string]map[string]struct{}, len(indexers)),
+	}
+	for name, fn := range indexers {
+		c.indexers[name] = fn
+		c.indices[name] = make(map[string]map[string]struct{})
+	}
+	return c
+}
+
+func (c *cache[T]) Get(key string) (T, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	obj, ok := c.items[key]
+	if !ok {
+		return obj, watchrelay.ErrNotFound
+	}
+	return obj, nil
+}
+
+func (c *cache[T]) List() []T {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	items := make([]T, 0, len(c.items))
+	for _, obj := range c.items {
+		items = append(items, obj)
+	}
+	return items
+}
+
+func (c *cache[T]) ByIndex(indexName, indexedValue string) ([]T, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	index, ok := c.indices[indexName]
+	if !ok {
+		return nil, fmt.Errorf("watchrelay: index %s does not exist", indexName)
+	}
+
+	keys := index[indexedValue]
+	items := make([]T, 0, len(keys))
+	for key := range keys {
+		items = append(items, c.items[key])
+	}
+	return items, nil
+}
+
+func (c *cache[T]) set(obj T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := obj.GetResourceKey()
+	if old, ok := c.items[key]; ok {
+		c.unindex(key, old)
+	}
+	c.items[key] = obj
+	c.index(key, obj)
+}
+
+func (c *cache[T]) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.items[key]; ok {
+		c.unindex(key, old)
+		delete(c.items, key)
+	}
+}
+
+// replace swaps the cached objects for items and returns the previous ones.
+func (c *cache[T]) replace(items []T) map[string]T {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old := c.items
+	c.items = make(map[string]T, len(items))
+	for name := range c.indices {
+		c.indices[name] = make(map[string]map[string]struct{})
+	}
+	for _, obj := range items {
+		key := obj.GetResourceKey()
+		c.items[key] = obj
+		c.index(key, obj)
+	}
+	return old
+}
+
+func (c *cache[T]) index(key string, obj T) {
+	for name, fn := range c.indexers {
+		values, err := fn(obj)
+		if err != nil {
+			c.log.Error("watchrelay: failed to index object", "key", key, "index", name, logging.KeyError, err)
+			continue
+		}
+		index := c.indices[name]
+		for _, value := range values {
+			keys, ok := index[value]
+			if !ok {
+				keys = make(map[string]struct{})
+				index[value] = keys
+			}
+			keys[key] = struct{}{}
+		}
+	}
+}
+
+func (c *cache[T]) unindex(key string, obj T) {
+	for name, fn := range c.indexers {
+		values, err := fn(obj)
+		if err != nil {
+			continue
+		}
+		index := c.indices[name]
+		for _, value := range values {
+			delete(index[value], key)
+			if len(index[value]) == 0 {
+				delete(index, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Package informer keeps a local, indexed cache of the resources of a
+// WatchRelay up to date and notifies handlers of their changes.
+package informer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hunknownz/watchrelay"
+	"github.com/hunknownz/watchrelay/event"
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/resource"
+)
+
+// relistBackoff is how long the informer waits before listing again after a
+// failed list.
+const relistBackoff = time.Second
+
+// EventHandler is notified of the changes to the objects of an informer.
+// Handlers are called one at a time and must not block.
+type EventHandler[T resource.IKeyedResource] interface {
+	OnAdd(obj T)
+	OnUpdate(oldObj, newObj T)
+	OnDelete(obj T)
+}
+
+// EventHandlerFuncs is an EventHandler calling the functions that are set.
+type EventHandlerFuncs[T resource.IKeyedResource] struct {
+	AddFunc    func(obj T)
+	UpdateFunc func(oldObj, newObj T)
+	DeleteFunc func(obj T)
+}
+
+func (f EventHandlerFuncs[T]) OnAdd(obj T) {
+	if f.AddFunc != nil {
+		f.AddFunc(obj)
+	}
+}
+
+func (f EventHandlerFuncs[T]) OnUpdate(oldObj, newObj T) {
+	if f.UpdateFunc != nil {
+		f.UpdateFunc(oldObj, newObj)
+	}
+}
+
+func (f EventHandlerFuncs[T]) OnDelete(obj T) {
+	if f.DeleteFunc != nil {
+		f.DeleteFunc(obj)
+	}
+}
+
+// Informer caches the objects of a resource registered with the relay. It
+// lists them, then watches their changes, listing again whenever the watch
+// cannot be resumed, e.g. when its revision has been compacted.
+type Informer[T resource.IKeyedResource] struct {
+	w            *watchrelay.WatchRelay
+	log          logging.Logger
+	resyncPeriod time.Duration
+	cache        *cache[T]
+	synced       atomic.Bool
+
+	// mu serializes changes to the cache with the notification of handlers.
+	mu       sync.Mutex
+	handlers []EventHandler[T]
+}
+
+// New creates an informer for the resource T. Every resyncPeriod, handlers are
+// notified of an update of every cached object to itself; zero disables resync.
+func New[T resource.IKeyedResource](w *watchrelay.WatchRelay, resyncPeriod time.Duration, indexers Indexers[T]) *Informer[T] {
+	var v T
+	log := w.Logger().With(logging.KeyResource, resource.GetResourceName(v))
+	return &Informer[T]{
+		w:            w,
+		log:          log,
+		resyncPeriod: resyncPeriod,
+		cache:        newCache(indexers, log),
+	}
+}
+
+// AddEventHandler registers h. Once the informer has synced, h is notified of
+// the addition of the objects already cached.
+func (i *Informer[T]) AddEventHandler(h EventHandler[T]) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.handlers = append(i.handlers, h)
+	if i.synced.Load() {
+		for _, obj := range i.cache.List() {
+			h.OnAdd(obj)
+		}
+	}
+}
+
+// Lister returns a Lister reading the cache of the informer.
+func (i *Informer[T]) Lister() Lister[T] {
+	return i.cache
+}
+
+// HasSynced reports whether the cache has been filled by a first list.
+func (i *Informer[T]) HasSynced() bool {
+	return i.synced.Load()
+}
+
+// Run keeps the cache up to date until ctx is done or the relay stops.
+func (i *Informer[T]) Run(ctx context.Context) {
+	var resync <-chan time.Time
+	if i.resyncPeriod > 0 {
+		ticker := time.NewTicker(i.resyncPeriod)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	for ctx.Err() == nil {
+		err := i.listAndWatch(ctx, resync)
+		if errors.Is(err, watchrelay.ErrClosed) {
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			i.log.WithContext(ctx).Error("watchrelay: informer failed, relisting", logging.KeyError, err)
+			select {
+			case <-ctx.Done():
+			case <-i.w.Done():
+				return
+			case <-time.After(relistBackoff):
+			}
+		}
+	}
+}
+
+// listAndWatch replaces the cache with a list and applies the changes made
+// after it until the watch ends.
+func (i *Informer[T]) listAndWatch(ctx context.Context, resync <-chan time.Time) error {
+	items, rev, err := watchrelay.List[T](i.w, ctx, nil)
+	if err != nil {
+		return err
+	}
+	i.replace(items)
+
+	wt := watchrelay.Watch[T](i.w, ctx, nil, rev+1, watchrelay.WithResume(0, relistBackoff))
+	defer wt.Stop()
+	for {
+		select {
+		case events, ok := <-wt.ResultChan():
+			if !ok {
+				return wt.Err()
+			}
+			i.apply(events)
+		case <-resync:
+			i.resync()
+		}
+	}
+}
+
+func (i *Informer[T]) replace(items []T) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	old := i.cache.replace(items)
+	for _, obj := range items {
+		key := obj.GetResourceKey()
+		oldObj, ok := old[key]
+		if !ok {
+			i.notifyAdd(obj)
+			continue
+		}
+		delete(old, key)
+		if oldObj.GetResourceVersion() != obj.GetResourceVersion() {
+			i.notifyUpdate(oldObj, obj)
+		}
+	}
+	for _, obj := range old {
+		i.notifyDelete(obj)
+	}
+	i.synced.Store(true)
+}
+
+func (i *Informer[T]) apply(events []*event.Event[T]) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, e := range events {
+		key := e.Value.GetResourceKey()
+		oldObj, err := i.cache.Get(key)
+		exists := err == nil
+		// Events already reflected by the list.
+		if exists && oldObj.GetResourceVersion() >= e.Revision {
+			continue
+		}
+
+		switch e.Action {
+		case event.EventActionCreate, event.EventActionUpdate:
+			i.cache.set(e.Value)
+			if exists {
+				i.notifyUpdate(oldObj, e.Value)
+			} else {
+				i.notifyAdd(e.Value)
+			}
+		case event.EventActionDelete:
+			if exists {
+				i.cache.delete(key)
+				i.notifyDelete(oldObj)
+			}
+		}
+	}
+}
+
+func (i *Informer[T]) resync() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, obj := range i.cache.List() {
+		i.notifyUpdate(obj, obj)
+	}
+}
+
+func (i *Informer[T]) notifyAdd(obj T) {
+	for _, h := range i.handlers {
+		h.OnAdd(obj)
+	}
+}
+
+func (i *Informer[T]) notifyUpdate(oldObj, newObj T) {
+	for _, h := range i.handlers {
+		h.OnUpdate(oldObj, newObj)
+	}
+}
+
+func (i *Informer[T]) notifyDelete(obj T) {
+	for _, h := range i.handlers {
+		h.OnDelete(obj)
+	}
+}
@@ -0,0 +1,252 @@
+package informer_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hunknownz/watchrelay"
+	"github.com/hunknownz/watchrelay/informer"
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/resource"
+	"github.com/hunknownz/watchrelay/sqllog"
+	"github.com/hunknownz/watchrelay/storage/memory"
+)
+
+type Task struct {
+	resource.Meta
+	Name  string
+	Owner string
+}
+
+func (t *Task) GetResourceKey() string {
+	return t.Name
+}
+
+// failingStore is a Store whose reads of the log fail while fail is set.
+type failingStore struct {
+	sqllog.Store
+	fail atomic.Bool
+}
+
+func (s *failingStore) After(ctx context.Context, resourceName string, revision uint64, limit int64) (sqllog.Rows, error) {
+	if s.fail.Load() {
+		return nil, errors.New("connection refused")
+	}
+	return s.Store.After(ctx, resourceName, revision, limit)
+}
+
+// newRelay returns a relay of Tasks keeping its log in store, running until
+// the returned function is called.
+func newRelay(t *testing.T, store sqllog.Store) (*watchrelay.WatchRelay, context.CancelFunc) {
+	t.Helper()
+
+	w, err := watchrelay.NewWatchRelayWithStore(store, watchrelay.WithPollInterval(10*time.Millisecond), watchrelay.WithLogger(logging.Discard()))
+	if err != nil {
+		t.Fatalf("NewWatchRelayWithStore: %v", err)
+	}
+	if err := watchrelay.RegisterResource[*Task](w); err != nil {
+		t.Fatalf("RegisterResource: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	w.Start(ctx)
+	return w, cancel
+}
+
+// recorder records the notifications of an informer as strings.
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recorder) add(s string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, s)
+}
+
+func (r *recorder) OnAdd(obj *Task) {
+	r.add("add " + obj.Name)
+}
+
+func (r *recorder) OnUpdate(oldObj, newObj *Task) {
+	if oldObj == newObj {
+		r.add("resync " + newObj.Name)
+		return
+	}
+	r.add("update " + newObj.Name + " " + oldObj.Owner + "->" + newObj.Owner)
+}
+
+func (r *recorder) OnDelete(obj *Task) {
+	r.add("delete " + obj.Name)
+}
+
+// wait waits for the notifications of want, in order, ignoring the others.
+func (r *recorder) wait(t *testing.T, want ...string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		events := append([]string(nil), r.events...)
+		r.mu.Unlock()
+
+		i := 0
+		for _, e := range events {
+			if i < len(want) && e == want[i] {
+				i++
+			}
+		}
+		if i == len(want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("notified %q, want %q", events, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// run runs inf until the test ends, waiting for it to sync.
+func run(t *testing.T, inf *informer.Informer[*Task]) <-chan struct{} {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		inf.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !inf.HasSynced() {
+		if time.Now().After(deadline) {
+			t.Fatal("informer did not sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return done
+}
+
+func byOwner(obj *Task) ([]string, error) {
+	return []string{obj.Owner}, nil
+}
+
+func TestInformerHandlers(t *testing.T) {
+	w, _ := newRelay(t, memory.New())
+	ctx := context.Background()
+
+	a, b := &Task{Name: "a", Owner: "alice"}, &Task{Name: "b", Owner: "alice"}
+	if err := watchrelay.Create[*Task](w, ctx, nil, nil, a, b); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	inf := informer.New[*Task](w, 0, informer.Indexers[*Task]{"owner": byOwner})
+	run(t, inf)
+
+	// A handler added once synced is notified of the cached objects, in no
+	// particular order.
+	rec := &recorder{}
+	inf.AddEventHandler(rec)
+	rec.wait(t, "add a")
+	rec.wait(t, "add b")
+
+	a.Owner = "bob"
+	if err := watchrelay.Update[*Task](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := watchrelay.Delete[*Task](w, ctx, nil, nil, b); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	rec.wait(t, "update a alice->bob", "delete b")
+
+	lister := inf.Lister()
+	if got, err := lister.Get("a"); err != nil || got.Owner != "bob" {
+		t.Errorf("Get returned %+v, %v, want a owned by bob", got, err)
+	}
+	if _, err := lister.Get("b"); !errors.Is(err, watchrelay.ErrNotFound) {
+		t.Errorf("Get of a deleted object returned %v, want ErrNotFound", err)
+	}
+	if objs, err := lister.ByIndex("owner", "bob"); err != nil || len(objs) != 1 || objs[0].Name != "a" {
+		t.Errorf("ByIndex returned %v, %v, want a", objs, err)
+	}
+	if objs, err := lister.ByIndex("owner", "alice"); err != nil || len(objs) != 0 {
+		t.Errorf("ByIndex returned %v, %v, want nothing", objs, err)
+	}
+}
+
+func TestInformerResync(t *testing.T) {
+	w, _ := newRelay(t, memory.New())
+	if err := watchrelay.Create[*Task](w, context.Background(), nil, nil, &Task{Name: "a"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	inf := informer.New[*Task](w, 20*time.Millisecond, nil)
+	rec := &recorder{}
+	inf.AddEventHandler(rec)
+	run(t, inf)
+
+	rec.wait(t, "add a", "resync a", "resync a")
+}
+
+func TestInformerRelist(t *testing.T) {
+	store := &failingStore{Store: memory.New()}
+	w, _ := newRelay(t, store)
+	ctx := context.Background()
+
+	a, b := &Task{Name: "a", Owner: "alice"}, &Task{Name: "b", Owner: "alice"}
+	if err := watchrelay.Create[*Task](w, ctx, nil, nil, a, b); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	a.Owner = "bob"
+	if err := watchrelay.Update[*Task](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	inf := informer.New[*Task](w, 0, nil)
+	rec := &recorder{}
+	inf.AddEventHandler(rec)
+	run(t, inf)
+	rec.wait(t, "add a")
+	rec.wait(t, "add b")
+
+	// While the watch of the informer is down, the changes it missed are
+	// compacted, so that it cannot resume and lists again.
+	store.fail.Store(true)
+	time.Sleep(100 * time.Millisecond)
+	b.Owner = "bob"
+	if err := watchrelay.Update[*Task](w, ctx, nil, nil, b); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := watchrelay.Create[*Task](w, ctx, nil, nil, &Task{Name: "c"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := store.ClearExpiredEvents(ctx, 0); err != nil {
+		t.Fatalf("ClearExpiredEvents: %v", err)
+	}
+	store.fail.Store(false)
+
+	rec.wait(t, "update b alice->bob")
+	rec.wait(t, "add c")
+}
+
+func TestInformerStopsWithRelay(t *testing.T) {
+	w, stop := newRelay(t, memory.New())
+	inf := informer.New[*Task](w, 0, nil)
+	done := run(t, inf)
+
+	stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("informer still running after the relay stopped")
+	}
+}
@@ -0,0 +1,148 @@
+// Package fakesql provides a database/sql driver answering statements with a
+// function, for testing the SQL dialects without a database server.
+package fakesql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Func answers a statement with the rows of its result, each holding the
+// values of its columns, or with an error.
+type Func func(query string, args []driver.Value) ([][]driver.Value, error)
+
+// Statement is a statement run on a DB.
+type Statement struct {
+	Query string
+	Args  []driver.Value
+}
+
+// Recorder records the statements run on a DB.
+type Recorder struct {
+	mu         sync.Mutex
+	statements []Statement
+}
+
+// Statements returns the statements run so far, in order.
+func (r *Recorder) Statements() []Statement {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Statement(nil), r.statements...)
+}
+
+func (r *Recorder) record(query string, args []driver.Value) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statements = append(r.statements, Statement{Query: query, Args: args})
+}
+
+// Open returns a DB answering its statements with fn, along with the recorder
+// of the statements. A nil fn answers every statement with no rows.
+func Open(fn Func) (*sql.DB, *Recorder) {
+	if fn == nil {
+		fn = func(string, []driver.Value) ([][]driver.Value, error) {
+			return nil, nil
+		}
+	}
+	c := &connector{fn: fn, rec: &Recorder{}}
+	return sql.OpenDB(c), c.rec
+}
+
+type connector struct {
+	fn  Func
+	rec *Recorder
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{c: c}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("fakesql: open with fakesql.Open")
+}
+
+type conn struct {
+	c *connector
+}
+
+func (c *conn) answer(query string, named []driver.NamedValue) ([][]driver.Value, error) {
+	args := make([]driver.Value, len(named))
+	for i, v := range named {
+		args[i] = v.Value
+	}
+	c.c.rec.record(query, args)
+	return c.c.fn(query, args)
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	rows, err := c.answer(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(len(rows)), nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values, err := c.answer(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{values: values}, nil
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("fakesql: prepared statements are not supported: %s", query)
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return tx{}, nil
+}
+
+type tx struct{}
+
+func (tx) Commit() error   { return nil }
+func (tx) Rollback() error { return nil }
+
+type rows struct {
+	values [][]driver.Value
+}
+
+func (r *rows) Columns() []string {
+	if len(r.values) == 0 {
+		return nil
+	}
+	columns := make([]string, len(r.values[0]))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("c%d", i)
+	}
+	return columns
+}
+
+func (r *rows) Close() error {
+	r.values = nil
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
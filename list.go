@@ -0,0 +1,320 @@
+package watchrelay
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/hunknownz/watchrelay/event"
+	"github.com/hunknownz/watchrelay/resource"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// snapshot runs fn in a read-only transaction reading a consistent snapshot
+// of the database, and passes it the relay revision of the snapshot.
+//
+// The revision is the newest one with no uncommitted revision below it, read
+// before the snapshot is taken; the snapshot may already reflect changes made
+// after it, which a watch from the revision delivers again.
+func (w *WatchRelay) snapshot(ctx context.Context, fn func(tx *gorm.DB, rev uint64) error) error {
+	rev, err := w.sqlLog.ConsistentRevision(ctx)
+	if err != nil {
+		return err
+	}
+
+	opts := &sql.TxOptions{ReadOnly: true}
+	switch w.db.Dialector.Name() {
+	case "mysql", "postgres":
+		opts.Isolation = sql.LevelRepeatableRead
+	}
+
+	return w.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(tx, rev)
+	}, opts)
+}
+
+// keyConditions maps the key of a T to the columns of its primary key.
+func keyConditions[T resource.IKeyedResource](db *gorm.DB, key string) (map[string]any, error) {
+	var t T
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(t); err != nil {
+		return nil, err
+	}
+
+	fields := stmt.Schema.PrimaryFields
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("watchrelay: resource %T has no primary key", t)
+	}
+	values := strings.SplitN(key, "/", len(fields))
+	if len(values) != len(fields) {
+		return nil, fmt.Errorf("watchrelay: key %q does not match the primary key of %T", key, t)
+	}
+
+	conds := make(map[string]any, len(fields))
+	for i, field := range fields {
+		value, err := parseKeyValue(field, values[i])
+		if err != nil {
+			return nil, fmt.Errorf("watchrelay: invalid key %q: %w", key, err)
+		}
+		conds[field.DBName] = value
+	}
+	return conds, nil
+}
+
+func parseKeyValue(field *schema.Field, value string) (any, error) {
+	switch field.IndirectFieldType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(value, 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseUint(value, 10, 64)
+	default:
+		return value, nil
+	}
+}
+
+// listStore decodes the current resources of a relay without a database.
+func listStore[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, resourceName string) (uint64, []T, error) {
+	rev, err := w.sqlLog.ConsistentRevision(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	events, err := w.sqlLog.List(ctx, resourceName, rev, 0, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	items := make([]T, 0, len(events))
+	for _, e := range events {
+		if e, ok := e.(*event.Event[T]); ok && e.Action != event.EventActionDelete {
+			items = append(items, e.Value)
+		}
+	}
+	return rev, items, nil
+}
+
+// Get returns the resource with the given key and the revision it was read at.
+// ErrNotFound is returned if it does not exist.
+func Get[T resource.IKeyedResource](w *WatchRelay, ctx context.Context, key string) (T, uint64, error) {
+	var res T
+	if w == nil {
+		return res, 0, errors.New("watchrelay: WatchRelay is nil")
+	}
+
+	resourceName := resource.GetResourceName(res)
+	if !w.sqlLog.IsRegisterd(resourceName) {
+		return res, 0, fmt.Errorf("watchrelay: resource %s not registered", resourceName)
+	}
+
+	if w.db == nil {
+		rev, items, err := listStore[T](w, ctx, resourceName)
+		if err != nil {
+			return res, 0, err
+		}
+		for _, item := range items {
+			if item.GetResourceKey() == key {
+				return item, rev, nil
+			}
+		}
+		return res, 0, ErrNotFound
+	}
+
+	conds, err := keyConditions[T](w.db, key)
+	if err != nil {
+		return res, 0, err
+	}
+
+	var rev uint64
+	err = w.snapshot(ctx, func(tx *gorm.DB, snapshotRev uint64) error {
+		t := new(T)
+		if err := tx.Where(conds).Take(t).Error; err != nil {
+			return err
+		}
+		res, rev = *t, snapshotRev
+		return nil
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = ErrNotFound
+	}
+	return res, rev, err
+}
+
+// List returns the resources satisfying cond and the revision they were read at.
+// Watching from the revision continues the list with the changes made after it,
+// some of which the list may already reflect.
+func List[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, cond ConditionFunc[T]) ([]T, uint64, error) {
+	if w == nil {
+		return nil, 0, errors.New("watchrelay: WatchRelay is nil")
+	}
+
+	var t T
+	resourceName := resource.GetResourceName(t)
+	if !w.sqlLog.IsRegisterd(resourceName) {
+		return nil, 0, fmt.Errorf("watchrelay: resource %s not registered", resourceName)
+	}
+
+	var (
+		rev   uint64
+		items []T
+	)
+	if w.db == nil {
+		var err error
+		rev, items, err = listStore[T](w, ctx, resourceName)
+		if err != nil {
+			return nil, 0, err
+		}
+	} else {
+		err := w.snapshot(ctx, func(tx *gorm.DB, snapshotRev uint64) error {
+			rev = snapshotRev
+			return tx.Find(&items).Error
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if cond == nil {
+		return items, rev, nil
+	}
+	filtered := items[:0]
+	for _, item := range items {
+		if cond(item) {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered, rev, nil
+}
+
+// DeleteByKey deletes the resource with the given key, whatever its version.
+// ErrNotFound is returned if it does not exist.
+func DeleteByKey[T resource.IKeyedResource](w *WatchRelay, ctx context.Context, beforeDelete, afterDelete BatchHook[T], key string) error {
+	for {
+		res, _, err := Get[T](w, ctx, key)
+		if err != nil {
+			return err
+		}
+
+		err = Delete(w, ctx, beforeDelete, afterDelete, res)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// ErrInvalidContinue is returned by ListPage when the continue token is malformed.
+var ErrInvalidContinue = errors.New("watchrelay: invalid continue token")
+
+// ListOptions selects a page of a paginated list.
+type ListOptions struct {
+	// Limit is the maximum number of resources in the page. Zero lists all
+	// the remaining resources.
+	Limit int64
+	// Continue is the token of the page to read, as returned with the previous
+	// page. An empty token reads the first page.
+	Continue string
+}
+
+// Page is a page of a paginated list.
+type Page[T resource.IVersionedResource] struct {
+	Items []T
+	// Revision is the revision the list is read at, shared by all its pages.
+	Revision uint64
+	// Continue is the token of the next page, empty on the last page.
+	Continue string
+}
+
+// continueToken locates a page: the revision of the list and the create
+// revision of the last object read, objects being listed in create order.
+type continueToken struct {
+	Revision       uint64 `json:"rev"`
+	CreateRevision uint64 `json:"start"`
+}
+
+func (t continueToken) encode() string {
+	b, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeContinue(s string) (continueToken, error) {
+	var t continueToken
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &t) != nil || t.Revision == 0 {
+		return t, ErrInvalidContinue
+	}
+	return t, nil
+}
+
+// ListPage returns a page of the resources satisfying cond. All the pages of
+// a list are read at the revision of its first page from the event log, so
+// resources changed while paginating show up as they were at that revision.
+// Pages are ordered by the creation of the resources.
+//
+// Unlike List, ListPage reads the event log rather than the table of T, so
+// rows written to the table outside of the relay and its Plugin do not show
+// up in the pages.
+//
+// ErrCompacted is returned once the log has been compacted past the revision
+// of the list; the list has to be restarted from the first page.
+func ListPage[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, cond ConditionFunc[T], opts ListOptions) (*Page[T], error) {
+	if w == nil {
+		return nil, errors.New("watchrelay: WatchRelay is nil")
+	}
+
+	var t T
+	resourceName := resource.GetResourceName(t)
+	if !w.sqlLog.IsRegisterd(resourceName) {
+		return nil, fmt.Errorf("watchrelay: resource %s not registered", resourceName)
+	}
+
+	var (
+		token continueToken
+		err   error
+	)
+	if opts.Continue == "" {
+		token.Revision, err = w.sqlLog.ConsistentRevision(ctx)
+	} else {
+		token, err = decodeContinue(opts.Continue)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page[T]{Revision: token.Revision}
+	for {
+		// One more than needed, to tell whether there is a next page.
+		var limit int64
+		if opts.Limit > 0 {
+			limit = opts.Limit - int64(len(page.Items)) + 1
+		}
+
+		events, err := w.sqlLog.List(ctx, resourceName, token.Revision, token.CreateRevision, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			if opts.Limit > 0 && int64(len(page.Items)) == opts.Limit {
+				page.Continue = token.encode()
+				return page, nil
+			}
+
+			token.CreateRevision = e.GetCreateRevision()
+			e, ok := e.(*event.Event[T])
+			if ok && e.Action != event.EventActionDelete && (cond == nil || cond(e.Value)) {
+				page.Items = append(page.Items, e.Value)
+			}
+		}
+		if limit == 0 || int64(len(events)) < limit {
+			return page, nil
+		}
+	}
+}
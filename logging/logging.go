@@ -0,0 +1,42 @@
+// Package logging defines the structured logger of the relay and adapters
+// for log/slog and logrus.
+package logging
+
+import "context"
+
+// Keys of the fields attached to log records.
+const (
+	KeyResource   = "resource"
+	KeyRevision   = "revision"
+	KeySubscriber = "subscriber"
+	KeyError      = "error"
+)
+
+// Logger is a structured logger. Args are alternating keys and values, as
+// with log/slog.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+	// With returns a logger adding args to every record.
+	With(args ...any) Logger
+	// WithContext returns a logger passing ctx to the handler of every
+	// record, e.g. for it to read the trace of the caller.
+	WithContext(ctx context.Context) Logger
+}
+
+type discard struct{}
+
+func (discard) Debug(string, ...any) {}
+func (discard) Info(string, ...any)  {}
+func (discard) Warn(string, ...any)  {}
+func (discard) Error(string, ...any) {}
+func (d discard) With(...any) Logger { return d }
+
+func (d discard) WithContext(context.Context) Logger { return d }
+
+// Discard returns a logger dropping every record.
+func Discard() Logger {
+	return discard{}
+}
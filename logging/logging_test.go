@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+type ctxKey struct{}
+
+// ctxHandler records the context of the last record it handled.
+type ctxHandler struct {
+	slog.Handler
+	ctx *context.Context
+}
+
+func (h ctxHandler) Handle(ctx context.Context, r slog.Record) error {
+	*h.ctx = ctx
+	return nil
+}
+
+func (h ctxHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ctxHandler{Handler: h.Handler.WithAttrs(attrs), ctx: h.ctx}
+}
+
+func TestSlogWithContext(t *testing.T) {
+	var got context.Context
+	l := NewSlog(slog.New(ctxHandler{Handler: slog.NewTextHandler(io.Discard, nil), ctx: &got}))
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "caller")
+	l.With(KeyResource, "task").WithContext(ctx).Info("watchrelay: test")
+	if got == nil || got.Value(ctxKey{}) != "caller" {
+		t.Fatalf("record handled with context %v, want the caller's", got)
+	}
+
+	// Loggers derived from it keep the context.
+	got = nil
+	l.WithContext(ctx).With(KeyRevision, 1).Info("watchrelay: test")
+	if got == nil || got.Value(ctxKey{}) != "caller" {
+		t.Fatalf("record handled with context %v, want the caller's", got)
+	}
+}
+
+// ctxHook records the context of the last entry it fired on.
+type ctxHook struct {
+	ctx context.Context
+}
+
+func (h *ctxHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *ctxHook) Fire(e *logrus.Entry) error {
+	h.ctx = e.Context
+	return nil
+}
+
+func TestLogrusWithContext(t *testing.T) {
+	hook := &ctxHook{}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.AddHook(hook)
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "caller")
+	NewLogrus(logger).With(KeyResource, "task").WithContext(ctx).Info("watchrelay: test")
+	if hook.ctx == nil || hook.ctx.Value(ctxKey{}) != "caller" {
+		t.Fatalf("entry fired with context %v, want the caller's", hook.ctx)
+	}
+}
@@ -0,0 +1,79 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/sirupsen/logrus"
+)
+
+// badKey is the key of a trailing value without a key, as named by log/slog.
+const badKey = "!BADKEY"
+
+type logrusLogger struct {
+	l logrus.FieldLogger
+}
+
+// NewLogrus adapts l, or the logrus standard logger if nil, to a Logger.
+func NewLogrus(l logrus.FieldLogger) Logger {
+	if l == nil {
+		l = logrus.StandardLogger()
+	}
+	return logrusLogger{l: l}
+}
+
+func (l logrusLogger) Debug(msg string, args ...any) {
+	l.l.WithFields(fields(args)).Debug(msg)
+}
+
+func (l logrusLogger) Info(msg string, args ...any) {
+	l.l.WithFields(fields(args)).Info(msg)
+}
+
+func (l logrusLogger) Warn(msg string, args ...any) {
+	l.l.WithFields(fields(args)).Warn(msg)
+}
+
+func (l logrusLogger) Error(msg string, args ...any) {
+	l.l.WithFields(fields(args)).Error(msg)
+}
+
+func (l logrusLogger) With(args ...any) Logger {
+	return logrusLogger{l: l.l.WithFields(fields(args))}
+}
+
+func (l logrusLogger) WithContext(ctx context.Context) Logger {
+	// logrus.FieldLogger leaves out WithContext, which *logrus.Logger and
+	// *logrus.Entry both have.
+	if c, ok := l.l.(interface {
+		WithContext(context.Context) *logrus.Entry
+	}); ok {
+		return logrusLogger{l: c.WithContext(ctx)}
+	}
+	return l
+}
+
+// fields converts alternating keys and values, or slog attributes, to
+// logrus fields.
+func fields(args []any) logrus.Fields {
+	f := make(logrus.Fields, len(args)/2)
+	for len(args) > 0 {
+		switch key := args[0].(type) {
+		case slog.Attr:
+			f[key.Key] = key.Value.Any()
+			args = args[1:]
+		case string:
+			if len(args) == 1 {
+				f[badKey] = key
+				return f
+			}
+			f[key] = args[1]
+			args = args[2:]
+		default:
+			f[badKey] = fmt.Sprint(key)
+			args = args[1:]
+		}
+	}
+	return f
+}
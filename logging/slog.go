@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+type slogLogger struct {
+	l   *slog.Logger
+	ctx context.Context
+}
+
+// NewSlog adapts l, or slog.Default() if nil, to a Logger.
+func NewSlog(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return slogLogger{l: l, ctx: context.Background()}
+}
+
+func (s slogLogger) Debug(msg string, args ...any) {
+	s.l.Log(s.ctx, slog.LevelDebug, msg, args...)
+}
+
+func (s slogLogger) Info(msg string, args ...any) {
+	s.l.Log(s.ctx, slog.LevelInfo, msg, args...)
+}
+
+func (s slogLogger) Warn(msg string, args ...any) {
+	s.l.Log(s.ctx, slog.LevelWarn, msg, args...)
+}
+
+func (s slogLogger) Error(msg string, args ...any) {
+	s.l.Log(s.ctx, slog.LevelError, msg, args...)
+}
+
+func (s slogLogger) With(args ...any) Logger {
+	return slogLogger{l: s.l.With(args...), ctx: s.ctx}
+}
+
+func (s slogLogger) WithContext(ctx context.Context) Logger {
+	return slogLogger{l: s.l, ctx: ctx}
+}
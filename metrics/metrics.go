@@ -0,0 +1,151 @@
+// Package metrics collects the metrics of a relay and serves them in the
+// Prometheus text format.
+package metrics
+
+import (
+	"net/http"
+	"time"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	latencyBuckets   = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	batchSizeBuckets = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024, 2048, 4096}
+)
+
+// Metrics are the metrics of a relay. A nil *Metrics discards everything, so
+// that instrumented code does not need to check whether metrics are enabled.
+type Metrics struct {
+	eventsWritten      *family
+	pollDuration       *family
+	pollBatchSize      *family
+	currentRevision    *family
+	databaseRevision   *family
+	revisionLag        *family
+	gapsFilled         *family
+	subscribers        *family
+	subscribersEvicted *family
+	compactionDeleted  *family
+}
+
+// New returns empty metrics.
+func New() *Metrics {
+	return &Metrics{
+		eventsWritten: newFamily("watchrelay_events_written_total",
+			"Events written to the event log.", typeCounter, nil, "resource", "action"),
+		pollDuration: newFamily("watchrelay_poll_duration_seconds",
+			"Latency of the queries polling the event log.", typeHistogram, latencyBuckets),
+		pollBatchSize: newFamily("watchrelay_poll_batch_size",
+			"Events read by a poll of the event log.", typeHistogram, batchSizeBuckets),
+		currentRevision: newFamily("watchrelay_current_revision",
+			"Revision up to which events have been broadcast to subscribers.", typeGauge, nil),
+		databaseRevision: newFamily("watchrelay_database_revision",
+			"Newest revision of the event log.", typeGauge, nil),
+		revisionLag: newFamily("watchrelay_revision_lag",
+			"Revisions of the event log not broadcast to subscribers yet.", typeGauge, nil),
+		gapsFilled: newFamily("watchrelay_gaps_filled_total",
+			"Revisions filled with a gap marker after never being committed.", typeCounter, nil),
+		subscribers: newFamily("watchrelay_subscribers",
+			"Active subscribers.", typeGauge, nil, "resource"),
+		subscribersEvicted: newFamily("watchrelay_subscribers_evicted_total",
+			"Subscribers closed for not keeping up with the events.", typeCounter, nil, "resource"),
+		compactionDeleted: newFamily("watchrelay_compaction_deleted_total",
+			"Events deleted by compaction.", typeCounter, nil),
+	}
+}
+
+func (m *Metrics) families() []*family {
+	return []*family{
+		m.eventsWritten,
+		m.pollDuration,
+		m.pollBatchSize,
+		m.currentRevision,
+		m.databaseRevision,
+		m.revisionLag,
+		m.gapsFilled,
+		m.subscribers,
+		m.subscribersEvicted,
+		m.compactionDeleted,
+	}
+}
+
+// EventWritten counts an event of resource committed to the event log.
+func (m *Metrics) EventWritten(resource, action string) {
+	if m == nil {
+		return
+	}
+	m.eventsWritten.add(1, resource, action)
+}
+
+// ObservePoll records a poll of the event log that read batchSize events.
+func (m *Metrics) ObservePoll(d time.Duration, batchSize int) {
+	if m == nil {
+		return
+	}
+	m.pollDuration.observe(d.Seconds())
+	m.pollBatchSize.observe(float64(batchSize))
+}
+
+// SetRevisions records the revision broadcast to subscribers and the newest
+// revision of the event log.
+func (m *Metrics) SetRevisions(current, database uint64) {
+	if m == nil {
+		return
+	}
+	m.currentRevision.set(float64(current))
+	m.databaseRevision.set(float64(database))
+	var lag uint64
+	if database > current {
+		lag = database - current
+	}
+	m.revisionLag.set(float64(lag))
+}
+
+// GapFilled counts a revision filled with a gap marker.
+func (m *Metrics) GapFilled() {
+	if m == nil {
+		return
+	}
+	m.gapsFilled.add(1)
+}
+
+// SubscriberAdded counts a new subscriber of resource.
+func (m *Metrics) SubscriberAdded(resource string) {
+	if m == nil {
+		return
+	}
+	m.subscribers.add(1, resource)
+}
+
+// SubscriberRemoved counts a closed subscriber of resource, evicted or not.
+func (m *Metrics) SubscriberRemoved(resource string, evicted bool) {
+	if m == nil {
+		return
+	}
+	m.subscribers.add(-1, resource)
+	if evicted {
+		m.subscribersEvicted.add(1, resource)
+	}
+}
+
+// CompactionDeleted counts n events deleted by compaction.
+func (m *Metrics) CompactionDeleted(n int) {
+	if m == nil {
+		return
+	}
+	m.compactionDeleted.add(float64(n))
+}
+
+// Handler returns a handler serving the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m == nil {
+			http.Error(w, "watchrelay: metrics are disabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		// A failed write means the client is gone, there is no one to tell.
+		_ = writeFamilies(w, m.families())
+	})
+}
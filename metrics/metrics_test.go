@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// golden compares got with the golden file name, or updates it with -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+// serve returns the response of the handler of m.
+func serve(t *testing.T, m *Metrics) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return rec
+}
+
+func TestHandler(t *testing.T) {
+	m := New()
+	m.EventWritten("task", "create")
+	m.EventWritten("task", "create")
+	m.EventWritten("task", "update")
+	m.EventWritten("we\"ird\\\nname", "delete")
+	m.ObservePoll(3*time.Millisecond, 5)
+	m.ObservePoll(2*time.Second, 0)
+	m.SetRevisions(7, 10)
+	m.GapFilled()
+	m.SubscriberAdded("task")
+	m.SubscriberAdded("task")
+	m.SubscriberAdded("user")
+	m.SubscriberRemoved("task", true)
+	m.SubscriberRemoved("user", false)
+	m.CompactionDeleted(4)
+
+	rec := serve(t, m)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != contentType {
+		t.Errorf("Content-Type %q, want %q", ct, contentType)
+	}
+	golden(t, "metrics.txt", rec.Body.Bytes())
+}
+
+func TestHandlerEmpty(t *testing.T) {
+	// Metrics without labels are exported before they change.
+	golden(t, "empty.txt", serve(t, New()).Body.Bytes())
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.EventWritten("task", "create")
+	m.ObservePoll(time.Millisecond, 1)
+	m.SetRevisions(1, 2)
+	m.GapFilled()
+	m.SubscriberAdded("task")
+	m.SubscriberRemoved("task", true)
+	m.CompactionDeleted(1)
+
+	if rec := serve(t, m); rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", rec.Code)
+	}
+}
+
+func TestWriteEscaping(t *testing.T) {
+	f := newFamily("test_total", "Help with a \\ and a\nnewline.", typeCounter, nil, "a", "b")
+	f.add(1, `back\slash`, `"quoted"`)
+	f.add(2, "new\nline", "")
+
+	var b strings.Builder
+	if err := writeFamilies(&b, []*family{f}); err != nil {
+		t.Fatalf("writeFamilies: %v", err)
+	}
+	want := `# HELP test_total Help with a \\ and a\nnewline.
+# TYPE test_total counter
+test_total{a="back\\slash",b="\"quoted\""} 1
+test_total{a="new\nline",b=""} 2
+`
+	if got := b.String(); got != want {
+		t.Errorf("wrote:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,243 @@
+package watchrelay
+
+import (
+	"time"
+
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/metrics"
+	"github.com/hunknownz/watchrelay/publisher"
+	"github.com/hunknownz/watchrelay/sqllog"
+	"github.com/hunknownz/watchrelay/tracing"
+)
+
+const (
+	defaultCompactInterval  = 5 * time.Minute
+	defaultCompactRetention = 24 * time.Hour
+	defaultResumeBackoff    = 100 * time.Millisecond
+)
+
+type options struct {
+	compactInterval  time.Duration
+	compactRetention time.Duration
+	allocator        AllocatorFunc
+	// log holds the settings threaded through the SQLLog and the dialect.
+	log sqllog.Config
+}
+
+// Option configures a WatchRelay.
+type Option func(*options)
+
+func newOptions(opts []Option) options {
+	o := options{
+		compactInterval:  defaultCompactInterval,
+		compactRetention: defaultCompactRetention,
+		allocator:        NewSequenceAllocator,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.log = o.log.WithDefaults()
+	return o
+}
+
+// WithCompaction sets how often the event log is compacted and how long
+// events are retained before being compacted. A zero interval disables
+// compaction.
+func WithCompaction(interval, retention time.Duration) Option {
+	return func(o *options) {
+		o.compactInterval = interval
+		o.compactRetention = retention
+	}
+}
+
+// WithRevisionAllocator sets how revisions are allocated, e.g. with
+// NewTableAllocator when several processes write to the same event log.
+// All writers of an event log must use the same kind of allocator.
+func WithRevisionAllocator(fn AllocatorFunc) Option {
+	return func(o *options) {
+		o.allocator = fn
+	}
+}
+
+// WithTableName sets the table of the event log, "watchrelay" by default.
+// The compaction table and the indexes of the log are named after it.
+func WithTableName(name string) Option {
+	return func(o *options) {
+		o.log.TableName = name
+	}
+}
+
+// WithPollInterval sets how often the event log is polled for new events,
+// every second by default.
+func WithPollInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.log.PollInterval = interval
+	}
+}
+
+// WithPollBatchSize sets the maximum number of events read by a poll, 512 by
+// default. A full batch is followed by another poll right away.
+func WithPollBatchSize(n int64) Option {
+	return func(o *options) {
+		o.log.PollBatchSize = n
+	}
+}
+
+// WithSubscriberBufferSize sets the number of batches of events buffered for
+// a watch that does not set its own with WithBufferSize, 128 by default.
+func WithSubscriberBufferSize(n int) Option {
+	return func(o *options) {
+		o.log.BufferSize = n
+	}
+}
+
+// WithLogger sets the logger of the relay and of its event log, the logrus
+// standard logger by default. See logging.NewSlog and logging.NewLogrus.
+func WithLogger(logger logging.Logger) Option {
+	return func(o *options) {
+		o.log.Logger = logger
+	}
+}
+
+// WithMetrics collects the metrics of the relay in m, to be served by
+// m.Handler().
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(o *options) {
+		o.log.Metrics = m
+	}
+}
+
+// WithTracer traces the writes of the relay, the queries of its event log and
+// its polls with tracer.
+func WithTracer(tracer tracing.Tracer) Option {
+	return func(o *options) {
+		o.log.Tracer = tracer
+	}
+}
+
+// WithPropagator stores the trace context of writers with their events, to be
+// exposed by Event.TraceContext.
+func WithPropagator(propagator tracing.Propagator) Option {
+	return func(o *options) {
+		o.log.Propagator = propagator
+	}
+}
+
+// Clock tells the time of events and timeouts.
+type Clock = sqllog.Clock
+
+// WithClock sets the clock of the relay, e.g. to control time in tests.
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.log.Clock = clock
+	}
+}
+
+type watchOptions struct {
+	prevValue     bool
+	initialEvents bool
+	resume        bool
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	subscribe     publisher.SubscribeOptions
+	annotations   map[string]string
+}
+
+// WatchOption configures a watch.
+type WatchOption func(*watchOptions)
+
+func newWatchOptions(opts []WatchOption) watchOptions {
+	var o watchOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithAnnotationSelector only sends the events having all the annotations
+// of selector, e.g. the changes made by an actor.
+func WithAnnotationSelector(selector map[string]string) WatchOption {
+	return func(o *watchOptions) {
+		o.annotations = selector
+	}
+}
+
+// WithPrevValue sets the PrevValue of update and delete events to the value
+// of the resource before the change.
+func WithPrevValue() WatchOption {
+	return func(o *watchOptions) {
+		o.prevValue = true
+	}
+}
+
+// WithInitialEvents starts a watch with the current state of the resources
+// instead of a revision. The resources are listed from a consistent snapshot
+// whose revision becomes the revision of the watch, and are sent as the first
+// batch of events, even if empty, as create events at their resource version.
+// The watch then continues with the changes made after the snapshot.
+func WithInitialEvents() WatchOption {
+	return func(o *watchOptions) {
+		o.initialEvents = true
+	}
+}
+
+// WithResume resumes a watch whose event stream is dropped, e.g. because its
+// consumer fell behind or the database failed, by replaying the events after
+// the last one delivered.
+// Attempts are retried after a delay doubling from minBackoff up to maxBackoff.
+// The watch only ends with an error once it cannot be resumed: when the
+// events to replay have been compacted, the relay stops or ctx is done.
+func WithResume(minBackoff, maxBackoff time.Duration) WatchOption {
+	if minBackoff <= 0 {
+		minBackoff = defaultResumeBackoff
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	return func(o *watchOptions) {
+		o.resume = true
+		o.minBackoff = minBackoff
+		o.maxBackoff = maxBackoff
+	}
+}
+
+// BackpressurePolicy decides what happens when the consumer of a watch does
+// not keep up with the events and its buffer is full.
+type BackpressurePolicy = publisher.Policy
+
+const (
+	// DropSubscriber ends the watch with ErrEvicted, unless it resumes.
+	DropSubscriber = publisher.PolicyDrop
+	// BlockWithTimeout holds back the events of all watches until the watch
+	// has room, for at most the block timeout before dropping it.
+	BlockWithTimeout = publisher.PolicyBlock
+	// CoalesceToLatest merges the buffered events, keeping only the latest
+	// event of every object. Intermediate changes are skipped.
+	CoalesceToLatest = publisher.PolicyCoalesce
+	// SpillToRelist drops the events while the watch lags, and catches up by
+	// reading the event log once its consumer has drained the buffer.
+	SpillToRelist = publisher.PolicySpill
+)
+
+// WithBackpressure sets the policy applied when the buffer of a watch is
+// full. The default is DropSubscriber.
+func WithBackpressure(policy BackpressurePolicy) WatchOption {
+	return func(o *watchOptions) {
+		o.subscribe.Policy = policy
+	}
+}
+
+// WithBlockTimeout sets how long BlockWithTimeout waits for room, 5s by default.
+func WithBlockTimeout(timeout time.Duration) WatchOption {
+	return func(o *watchOptions) {
+		o.subscribe.BlockTimeout = timeout
+	}
+}
+
+// WithBufferSize sets the number of batches of events buffered for the
+// consumer of a watch, 128 by default.
+func WithBufferSize(n int) WatchOption {
+	return func(o *watchOptions) {
+		o.subscribe.BufferSize = n
+	}
+}
@@ -0,0 +1,643 @@
+package watchrelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/hunknownz/watchrelay/event"
+	"github.com/hunknownz/watchrelay/resource"
+	"github.com/hunknownz/watchrelay/tracing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"gorm.io/gorm/utils"
+)
+
+const (
+	// relayedKey marks the statements of the relay itself, which log their
+	// events without the plugin.
+	relayedKey = "watchrelay:relayed"
+	// writeKey holds the pluginWrite of a statement between its callbacks.
+	writeKey = "watchrelay:write"
+)
+
+// ErrNoTransaction is returned by writes of relayed resources made through
+// gorm outside of a transaction, e.g. with SkipDefaultTransaction.
+var ErrNoTransaction = errors.New("watchrelay: relayed writes must run in a transaction")
+
+// relayed marks tx as writing resources whose events are logged by the relay.
+func relayed(tx *gorm.DB) *gorm.DB {
+	return tx.Set(relayedKey, true)
+}
+
+// Plugin relays the writes of the resources registered with a WatchRelay made
+// through plain gorm calls, like db.Create, db.Save, db.Updates and db.Delete,
+// including batches and writes selecting rows with Where. Resource versions
+// are allocated by the relay and the log events are inserted in the
+// transaction of the write. Writes made with Create, Update, Patch and Delete
+// of the relay are left to them.
+//
+// Unlike Update and Delete of the relay, the writes are not checked against
+// the resource version the caller read. Rows written by upserts, like db.Save
+// of a slice, are told apart from new rows by primary key.
+type Plugin struct {
+	w *WatchRelay
+}
+
+// NewPlugin returns the Plugin of w, to be installed with db.Use.
+func NewPlugin(w *WatchRelay) *Plugin {
+	return &Plugin{w: w}
+}
+
+func (p *Plugin) Name() string {
+	return "watchrelay"
+}
+
+func (p *Plugin) Initialize(db *gorm.DB) error {
+	if p.w == nil {
+		return errors.New("watchrelay: WatchRelay is nil")
+	}
+	if p.w.db == nil {
+		return errors.New("watchrelay: plugin requires a relay with a database")
+	}
+
+	create := db.Callback().Create()
+	if err := create.After("gorm:before_create").Before("gorm:create").Register("watchrelay:before_create", p.beforeCreate); err != nil {
+		return err
+	}
+	if err := create.After("gorm:create").Register("watchrelay:after_create", p.afterCreate); err != nil {
+		return err
+	}
+
+	update := db.Callback().Update()
+	if err := update.After("gorm:before_update").Before("gorm:update").Register("watchrelay:before_update", p.beforeUpdate); err != nil {
+		return err
+	}
+	if err := update.After("gorm:update").Register("watchrelay:after_update", p.afterUpdate); err != nil {
+		return err
+	}
+
+	delete := db.Callback().Delete()
+	if err := delete.After("gorm:before_delete").Before("gorm:delete").Register("watchrelay:before_delete", p.beforeDelete); err != nil {
+		return err
+	}
+	return delete.After("gorm:delete").Register("watchrelay:after_delete", p.afterDelete)
+}
+
+// pluginWrite is a write relayed by the plugin.
+type pluginWrite struct {
+	resourceName string
+	ctx          context.Context
+	span         tracing.Span
+	// objects are the resources written by a create.
+	objects []resource.IVersionedResource
+	// prevRevs are the revisions of the existing rows written, by primary key.
+	prevRevs map[string]uint64
+	// doNothing is set for upserts leaving existing rows as they are.
+	doNothing bool
+	// rows are the rows selected by an update or delete, read before the write.
+	rows []resource.IVersionedResource
+}
+
+// begin starts relaying the write of db, unless its model is not a registered
+// resource or the write is made by the relay.
+func (p *Plugin) begin(db *gorm.DB, op string) (*pluginWrite, bool) {
+	stmt := db.Statement
+	if db.Error != nil || stmt.Schema == nil {
+		return nil, false
+	}
+	if skip, _ := db.Get(relayedKey); skip == true {
+		return nil, false
+	}
+	res, ok := reflect.New(stmt.Schema.ModelType).Interface().(resource.IVersionedResource)
+	if !ok {
+		return nil, false
+	}
+	resourceName := resource.GetResourceName(res)
+	if !p.w.sqlLog.IsRegisterd(resourceName) {
+		return nil, false
+	}
+
+	if _, ok := stmt.ConnPool.(gorm.TxCommitter); !ok {
+		db.AddError(ErrNoTransaction)
+		return nil, false
+	}
+	if len(stmt.Schema.PrimaryFields) == 0 {
+		db.AddError(fmt.Errorf("watchrelay: resource %s has no primary key", resourceName))
+		return nil, false
+	}
+
+	ctx, span := p.w.opts.log.Tracer.Start(stmt.Context, "watchrelay.gorm."+op, tracing.Attr(tracing.KeyResource, resourceName))
+	pw := &pluginWrite{resourceName: resourceName, ctx: ctx, span: span}
+	db.InstanceSet(writeKey, pw)
+	return pw, true
+}
+
+// write returns the write of db started by begin.
+func (p *Plugin) write(db *gorm.DB) (*pluginWrite, bool) {
+	v, ok := db.InstanceGet(writeKey)
+	if !ok {
+		return nil, false
+	}
+	return v.(*pluginWrite), true
+}
+
+// end ends the span of the write with the outcome of db.
+func (pw *pluginWrite) end(db *gorm.DB) {
+	if db.Error != nil {
+		pw.span.RecordError(db.Error)
+	}
+	pw.span.End()
+}
+
+// session returns a session for the queries of the plugin in the
+// transaction of db.
+func (p *Plugin) session(db *gorm.DB, ctx context.Context) *gorm.DB {
+	return db.Session(&gorm.Session{NewDB: true, Context: ctx})
+}
+
+func (p *Plugin) beforeCreate(db *gorm.DB) {
+	pw, ok := p.begin(db, "Create")
+	if !ok {
+		return
+	}
+
+	objs, err := objects(db.Statement.ReflectValue)
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	pw.objects = objs
+
+	// Upserts may write existing rows, which are recorded as updates.
+	if c, ok := db.Statement.Clauses["ON CONFLICT"]; ok {
+		// Soft deleted rows conflict too.
+		rows, err := p.load(db, pw.ctx, true, keyCondition(db.Statement, objs))
+		if err != nil {
+			db.AddError(err)
+			return
+		}
+		pw.prevRevs = make(map[string]uint64, len(rows))
+		for _, row := range rows {
+			pw.prevRevs[primaryKey(db.Statement, row)] = row.GetResourceVersion()
+		}
+		onConflict, _ := c.Expression.(clause.OnConflict)
+		pw.doNothing = onConflict.DoNothing
+	}
+
+	tx := p.session(db, pw.ctx)
+	for _, obj := range objs {
+		if prevRev, ok := pw.prevRevs[primaryKey(db.Statement, obj)]; ok && pw.doNothing {
+			// The existing row is left as it is, without a new revision.
+			obj.SetResourceVersion(prevRev)
+			continue
+		}
+		rev, err := p.w.revs.Allocate(pw.ctx, tx)
+		if err != nil {
+			db.AddError(err)
+			return
+		}
+		obj.SetResourceVersion(rev)
+	}
+}
+
+func (p *Plugin) afterCreate(db *gorm.DB) {
+	pw, ok := p.write(db)
+	if !ok {
+		return
+	}
+	defer pw.end(db)
+	if db.Error != nil {
+		return
+	}
+
+	var (
+		created  []resource.IVersionedResource
+		existing []resource.IVersionedResource
+		revs     []uint64
+	)
+	for _, obj := range pw.objects {
+		if _, ok := pw.prevRevs[primaryKey(db.Statement, obj)]; !ok {
+			created = append(created, obj)
+		} else if !pw.doNothing {
+			existing = append(existing, obj)
+			revs = append(revs, obj.GetResourceVersion())
+		}
+	}
+
+	// Rows conflicting on other unique keys are left out too. RowsAffected
+	// cannot tell, as some drivers count the rows scanned by RETURNING.
+	if pw.doNothing && len(created) > 0 {
+		var err error
+		created, err = p.inserted(db, pw, created)
+		if err != nil {
+			db.AddError(err)
+			return
+		}
+	}
+
+	events := make([]*event.LogEvent, 0, len(created)+len(existing))
+	for _, obj := range created {
+		e, err := newLogEvent(pw.resourceName, event.EventActionCreate, obj, p.w.opts.log.Clock.Now())
+		if err != nil {
+			db.AddError(err)
+			return
+		}
+		e.CreateRevision = e.Revision
+		events = append(events, e)
+	}
+	if len(existing) > 0 {
+		_, updates, err := p.updated(db, pw, existing, revs)
+		if err != nil {
+			db.AddError(err)
+			return
+		}
+		events = append(events, updates...)
+	}
+
+	db.AddError(p.log(db, pw, events))
+}
+
+// inserted returns the objects of an upsert leaving existing rows as they are
+// whose rows were inserted, telling them by the revisions allocated to them.
+// The revisions of the other objects are logged as gaps, for watchers not to
+// wait for them, and their versions are reset as they were not written.
+func (p *Plugin) inserted(db *gorm.DB, pw *pluginWrite, objects []resource.IVersionedResource) ([]resource.IVersionedResource, error) {
+	field, err := versionField(db.Statement, pw.resourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	revs := make([]any, len(objects))
+	for i, obj := range objects {
+		revs[i] = obj.GetResourceVersion()
+	}
+	var insertedRevs []uint64
+	err = p.session(db, pw.ctx).Table(db.Statement.Table).
+		Where(clause.IN{Column: clause.Column{Name: field.DBName}, Values: revs}).
+		Pluck(field.DBName, &insertedRevs).Error
+	if err != nil {
+		return nil, err
+	}
+	isInserted := make(map[uint64]bool, len(insertedRevs))
+	for _, rev := range insertedRevs {
+		isInserted[rev] = true
+	}
+
+	var (
+		inserted []resource.IVersionedResource
+		gaps     []*event.LogEvent
+	)
+	for _, obj := range objects {
+		rev := obj.GetResourceVersion()
+		if isInserted[rev] {
+			inserted = append(inserted, obj)
+			continue
+		}
+		gaps = append(gaps, &event.LogEvent{
+			Revision:       rev,
+			CreateRevision: rev,
+			Created:        true,
+			Deleted:        true,
+			CreatedAt:      p.w.opts.log.Clock.Now(),
+		})
+		obj.SetResourceVersion(0)
+	}
+	if len(gaps) > 0 {
+		err := p.session(db, pw.ctx).Table(p.w.opts.log.TableName).Create(gaps).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return inserted, nil
+}
+
+func (p *Plugin) beforeUpdate(db *gorm.DB) {
+	pw, ok := p.begin(db, "Update")
+	if !ok {
+		return
+	}
+	p.selectRows(db, pw)
+}
+
+func (p *Plugin) afterUpdate(db *gorm.DB) {
+	pw, ok := p.write(db)
+	if !ok {
+		return
+	}
+	defer pw.end(db)
+	if db.Error != nil || len(pw.rows) == 0 {
+		return
+	}
+
+	tx := p.session(db, pw.ctx)
+	revs := make([]uint64, len(pw.rows))
+	for i := range pw.rows {
+		rev, err := p.w.revs.Allocate(pw.ctx, tx)
+		if err != nil {
+			db.AddError(err)
+			return
+		}
+		revs[i] = rev
+	}
+
+	rows, events, err := p.updated(db, pw, pw.rows, revs)
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	p.syncVersions(db, rows)
+	db.AddError(p.log(db, pw, events))
+}
+
+func (p *Plugin) beforeDelete(db *gorm.DB) {
+	pw, ok := p.begin(db, "Delete")
+	if !ok {
+		return
+	}
+	p.selectRows(db, pw)
+}
+
+func (p *Plugin) afterDelete(db *gorm.DB) {
+	pw, ok := p.write(db)
+	if !ok {
+		return
+	}
+	defer pw.end(db)
+	if db.Error != nil || len(pw.rows) == 0 {
+		return
+	}
+	if db.RowsAffected != int64(len(pw.rows)) {
+		db.AddError(fmt.Errorf("watchrelay: deleted %d rows of %s, selected %d", db.RowsAffected, pw.resourceName, len(pw.rows)))
+		return
+	}
+
+	tx := p.session(db, pw.ctx)
+	events := make([]*event.LogEvent, len(pw.rows))
+	prevRevs := make([]uint64, len(pw.rows))
+	for i, row := range pw.rows {
+		prevRevs[i] = row.GetResourceVersion()
+		rev, err := p.w.revs.Allocate(pw.ctx, tx)
+		if err != nil {
+			db.AddError(err)
+			return
+		}
+		row.SetResourceVersion(rev)
+
+		e, err := newLogEvent(pw.resourceName, event.EventActionDelete, row, p.w.opts.log.Clock.Now())
+		if err != nil {
+			db.AddError(err)
+			return
+		}
+		events[i] = e
+	}
+	if err := p.w.chain(pw.ctx, tx, events, prevRevs); err != nil {
+		db.AddError(err)
+		return
+	}
+
+	// Soft deleted rows are kept, at the revision of their delete.
+	if !db.Statement.Unscoped && len(db.Statement.Schema.DeleteClauses) > 0 {
+		revs := make([]uint64, len(pw.rows))
+		for i, row := range pw.rows {
+			revs[i] = row.GetResourceVersion()
+		}
+		if err := p.setVersions(db, pw, pw.rows, revs); err != nil {
+			db.AddError(err)
+			return
+		}
+	}
+
+	p.syncVersions(db, pw.rows)
+	db.AddError(p.log(db, pw, events))
+}
+
+// selectRows reads the rows an update or delete is about to write, locking
+// them until the end of the transaction.
+func (p *Plugin) selectRows(db *gorm.DB, pw *pluginWrite) {
+	stmt := db.Statement
+
+	var conds []clause.Expression
+	if c, ok := stmt.Clauses["WHERE"]; ok {
+		if where, ok := c.Expression.(clause.Where); ok && len(where.Exprs) > 0 {
+			conds = append(conds, where)
+		}
+	}
+	// Like gorm, select the rows by the primary keys of the written value and
+	// of the model.
+	values := []reflect.Value{stmt.ReflectValue}
+	if stmt.Model != nil && stmt.Dest != stmt.Model {
+		values = append(values, reflect.ValueOf(stmt.Model))
+	}
+	for _, v := range values {
+		_, keys := schema.GetIdentityFieldValuesMap(stmt.Context, reflect.Indirect(v), stmt.Schema.PrimaryFields)
+		column, keyValues := schema.ToQueryValues(stmt.Table, stmt.Schema.PrimaryFieldDBNames, keys)
+		if len(keyValues) > 0 {
+			conds = append(conds, clause.Where{Exprs: []clause.Expression{clause.IN{Column: column, Values: keyValues}}})
+		}
+	}
+	if len(conds) == 0 && !stmt.AllowGlobalUpdate {
+		// gorm refuses the write.
+		return
+	}
+
+	rows, err := p.load(db, pw.ctx, stmt.Unscoped, conds...)
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	pw.rows = rows
+}
+
+// load reads the rows of the model of db satisfying conds, locking them.
+// Unless unscoped, soft deleted rows are left out.
+func (p *Plugin) load(db *gorm.DB, ctx context.Context, unscoped bool, conds ...clause.Expression) ([]resource.IVersionedResource, error) {
+	stmt := db.Statement
+	tx := p.session(db, ctx).Model(reflect.New(stmt.Schema.ModelType).Interface()).Table(stmt.Table)
+	if unscoped {
+		tx = tx.Unscoped()
+	}
+	if db.Dialector.Name() != "sqlite" {
+		tx = tx.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+
+	rows := reflect.New(reflect.SliceOf(reflect.PointerTo(stmt.Schema.ModelType)))
+	if err := tx.Clauses(conds...).Find(rows.Interface()).Error; err != nil {
+		return nil, err
+	}
+	return objects(rows.Elem())
+}
+
+// updated sets the resource versions of the existing rows of objects to revs
+// and returns the rows as written along with their update events.
+func (p *Plugin) updated(db *gorm.DB, pw *pluginWrite, objects []resource.IVersionedResource, revs []uint64) ([]resource.IVersionedResource, []*event.LogEvent, error) {
+	stmt := db.Statement
+	prevRevs := pw.prevRevs
+	if prevRevs == nil {
+		prevRevs = make(map[string]uint64, len(pw.rows))
+		for _, row := range pw.rows {
+			prevRevs[primaryKey(stmt, row)] = row.GetResourceVersion()
+		}
+	}
+
+	if err := p.setVersions(db, pw, objects, revs); err != nil {
+		return nil, nil, err
+	}
+
+	// Read the rows back, as the write may have changed them in ways the
+	// objects do not tell, e.g. with expressions.
+	rows, err := p.load(db, pw.ctx, true, keyCondition(stmt, objects))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	events := make([]*event.LogEvent, len(rows))
+	eventPrevRevs := make([]uint64, len(rows))
+	for i, row := range rows {
+		e, err := newLogEvent(pw.resourceName, event.EventActionUpdate, row, p.w.opts.log.Clock.Now())
+		if err != nil {
+			return nil, nil, err
+		}
+		events[i] = e
+		eventPrevRevs[i] = prevRevs[primaryKey(stmt, row)]
+	}
+	if err := p.w.chain(pw.ctx, p.session(db, pw.ctx), events, eventPrevRevs); err != nil {
+		return nil, nil, err
+	}
+	return rows, events, nil
+}
+
+// setVersions sets the resource versions of the rows of objects to revs.
+func (p *Plugin) setVersions(db *gorm.DB, pw *pluginWrite, objects []resource.IVersionedResource, revs []uint64) error {
+	field, err := versionField(db.Statement, pw.resourceName)
+	if err != nil {
+		return err
+	}
+
+	tx := relayed(p.session(db, pw.ctx)).Unscoped().Table(db.Statement.Table).Session(&gorm.Session{})
+	for i, obj := range objects {
+		if err := tx.Model(obj).UpdateColumn(field.DBName, revs[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncVersions sets the resource versions of the values written by db to
+// those of rows.
+func (p *Plugin) syncVersions(db *gorm.DB, rows []resource.IVersionedResource) {
+	values, err := objects(db.Statement.ReflectValue)
+	if err != nil {
+		// e.g. a map of the updated columns
+		return
+	}
+
+	revs := make(map[string]uint64, len(rows))
+	for _, row := range rows {
+		revs[primaryKey(db.Statement, row)] = row.GetResourceVersion()
+	}
+	for _, v := range values {
+		if rev, ok := revs[primaryKey(db.Statement, v)]; ok {
+			v.SetResourceVersion(rev)
+		}
+	}
+}
+
+// log inserts the events of the write in its transaction.
+func (p *Plugin) log(db *gorm.DB, pw *pluginWrite, events []*event.LogEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	if err := p.w.annotate(pw.ctx, events); err != nil {
+		return err
+	}
+	tx := p.session(db, pw.ctx)
+	if err := tx.Table(p.w.opts.log.TableName).Create(events).Error; err != nil {
+		return err
+	}
+
+	pw.span.SetAttributes(tracing.Attr(tracing.KeyEvents, len(events)))
+	for _, e := range events {
+		p.w.opts.log.Metrics.EventWritten(e.ResourceName, e.Action().String())
+	}
+	return nil
+}
+
+// objects returns the resources held by v, a resource or a slice of them.
+func objects(v reflect.Value) ([]resource.IVersionedResource, error) {
+	v = reflect.Indirect(v)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		objs := make([]resource.IVersionedResource, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			obj, err := object(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, obj)
+		}
+		return objs, nil
+	case reflect.Struct:
+		obj, err := object(v)
+		if err != nil {
+			return nil, err
+		}
+		return []resource.IVersionedResource{obj}, nil
+	}
+	return nil, fmt.Errorf("watchrelay: cannot relay writes of %s", v.Type())
+}
+
+func object(v reflect.Value) (resource.IVersionedResource, error) {
+	if v.Kind() != reflect.Ptr {
+		if !v.CanAddr() {
+			return nil, fmt.Errorf("watchrelay: cannot relay writes of unaddressable %s", v.Type())
+		}
+		v = v.Addr()
+	}
+	if v.IsNil() {
+		return nil, errors.New("watchrelay: cannot relay writes of nil resources")
+	}
+	obj, ok := v.Interface().(resource.IVersionedResource)
+	if !ok {
+		return nil, fmt.Errorf("watchrelay: %s is not a versioned resource", v.Type())
+	}
+	return obj, nil
+}
+
+// primaryKey returns the primary key of obj, a resource of the model of stmt.
+func primaryKey(stmt *gorm.Statement, obj resource.IVersionedResource) string {
+	v := reflect.Indirect(reflect.ValueOf(obj))
+	values := make([]any, len(stmt.Schema.PrimaryFields))
+	for i, field := range stmt.Schema.PrimaryFields {
+		values[i], _ = field.ValueOf(stmt.Context, v)
+	}
+	return utils.ToStringKey(values...)
+}
+
+// keyCondition selects the rows of objects by primary key.
+func keyCondition(stmt *gorm.Statement, objects []resource.IVersionedResource) clause.Expression {
+	keys := make([][]any, 0, len(objects))
+	for _, obj := range objects {
+		v := reflect.Indirect(reflect.ValueOf(obj))
+		values := make([]any, len(stmt.Schema.PrimaryFields))
+		zero := true
+		for i, field := range stmt.Schema.PrimaryFields {
+			var isZero bool
+			values[i], isZero = field.ValueOf(stmt.Context, v)
+			zero = zero && isZero
+		}
+		if !zero {
+			keys = append(keys, values)
+		}
+	}
+	if len(keys) == 0 {
+		// Nothing can match, e.g. rows with auto-incremented keys to be created.
+		return clause.Expr{SQL: "1 = 0"}
+	}
+	column, values := schema.ToQueryValues(stmt.Table, stmt.Schema.PrimaryFieldDBNames, keys)
+	return clause.IN{Column: column, Values: values}
+}
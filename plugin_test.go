@@ -0,0 +1,317 @@
+package watchrelay_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	wr "github.com/hunknownz/watchrelay"
+	"github.com/hunknownz/watchrelay/event"
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/resource"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+type Item struct {
+	ID uint `gorm:"primaryKey"`
+	resource.Meta
+	Name      string `gorm:"uniqueIndex"`
+	Owner     string
+	DeletedAt gorm.DeletedAt
+}
+
+// newSQLiteRelay returns a started relay of Items logging to a sqlite
+// database, with the plugin installed on the returned db.
+func newSQLiteRelay(t *testing.T, opts ...wr.Option) (*gorm.DB, *wr.WatchRelay) {
+	t.Helper()
+	return startSQLiteRelay(t, filepath.Join(t.TempDir(), "watchrelay.db"), opts...)
+}
+
+// startSQLiteRelay is newSQLiteRelay for the sqlite database in file, which
+// can be shared by several relays.
+func startSQLiteRelay(t *testing.T, file string, opts ...wr.Option) (*gorm.DB, *wr.WatchRelay) {
+	t.Helper()
+
+	// Transactions take the write lock as they begin, waiting for those of
+	// the other relays instead of failing.
+	db, err := gorm.Open(sqlite.Open(file+"?_busy_timeout=5000&_txlock=immediate"), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("gorm.Open: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("DB: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&Item{}); err != nil {
+		t.Fatalf("AutoMigrate: %v", err)
+	}
+
+	opts = append([]wr.Option{wr.WithPollInterval(10 * time.Millisecond), wr.WithLogger(logging.Discard())}, opts...)
+	w, err := wr.NewWatchRelay(db, opts...)
+	if err != nil {
+		t.Fatalf("NewWatchRelay: %v", err)
+	}
+	if err := wr.RegisterResource[*Item](w); err != nil {
+		t.Fatalf("RegisterResource: %v", err)
+	}
+	if err := db.Use(wr.NewPlugin(w)); err != nil {
+		t.Fatalf("Use: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	w.Start(ctx)
+	return db, w
+}
+
+type wantItemEvent struct {
+	action         event.EventAction
+	revision       uint64
+	createRevision uint64
+	prevRevision   uint64
+	name           string
+}
+
+// checkLog compares the events logged for Items with want.
+func checkLog(t *testing.T, w *wr.WatchRelay, want []wantItemEvent) {
+	t.Helper()
+
+	_, events, err := wr.After[*Item](w, context.Background(), nil, 0, 0)
+	if err != nil {
+		t.Fatalf("After: %v", err)
+	}
+	if len(events) != len(want) {
+		t.Fatalf("logged %d events, want %d", len(events), len(want))
+	}
+	for i, e := range events {
+		w := want[i]
+		if e.Action != w.action || e.Revision != w.revision || e.CreateRevision != w.createRevision || e.PrevRevision != w.prevRevision {
+			t.Errorf("event %d: got %s rev=%d create=%d prev=%d, want %s rev=%d create=%d prev=%d", i,
+				e.Action, e.Revision, e.CreateRevision, e.PrevRevision, w.action, w.revision, w.createRevision, w.prevRevision)
+		}
+		if e.Value.Name != w.name || e.Value.GetResourceVersion() != w.revision {
+			t.Errorf("event %d: got value %+v, want name %q at version %d", i, e.Value, w.name, w.revision)
+		}
+	}
+}
+
+// versions returns the resource versions of the rows of Items by name,
+// including the soft deleted ones.
+func versions(t *testing.T, db *gorm.DB) map[string]uint64 {
+	t.Helper()
+
+	var items []Item
+	if err := db.Unscoped().Find(&items).Error; err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	versions := make(map[string]uint64, len(items))
+	for _, item := range items {
+		versions[item.Name] = item.ResourceVersion
+	}
+	return versions
+}
+
+func TestPluginBatchCreate(t *testing.T) {
+	db, w := newSQLiteRelay(t)
+
+	items := []*Item{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+	if err := db.Create(&items).Error; err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for i, item := range items {
+		if item.ResourceVersion != uint64(i+1) {
+			t.Errorf("item %s at version %d, want %d", item.Name, item.ResourceVersion, i+1)
+		}
+	}
+
+	checkLog(t, w, []wantItemEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+		{event.EventActionCreate, 2, 2, 0, "b"},
+		{event.EventActionCreate, 3, 3, 0, "c"},
+	})
+}
+
+func TestPluginDeleteWhere(t *testing.T) {
+	db, w := newSQLiteRelay(t)
+
+	items := []*Item{{Name: "a", Owner: "alice"}, {Name: "b", Owner: "alice"}, {Name: "c", Owner: "bob"}}
+	if err := db.Create(&items).Error; err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// Soft deleted rows are kept at the revision of their delete.
+	if err := db.Where("owner = ?", "alice").Delete(&Item{}).Error; err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := db.Unscoped().Where("owner = ?", "bob").Delete(&Item{}).Error; err != nil {
+		t.Fatalf("Unscoped Delete: %v", err)
+	}
+
+	checkLog(t, w, []wantItemEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+		{event.EventActionCreate, 2, 2, 0, "b"},
+		{event.EventActionCreate, 3, 3, 0, "c"},
+		{event.EventActionDelete, 4, 1, 1, "a"},
+		{event.EventActionDelete, 5, 2, 2, "b"},
+		{event.EventActionDelete, 6, 3, 3, "c"},
+	})
+	got := versions(t, db)
+	if len(got) != 2 || got["a"] != 4 || got["b"] != 5 {
+		t.Errorf("rows at versions %v, want a at 4 and b at 5", got)
+	}
+}
+
+func TestPluginUpsert(t *testing.T) {
+	db, w := newSQLiteRelay(t)
+
+	a := &Item{Name: "a", Owner: "alice"}
+	if err := db.Create(a).Error; err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	items := []*Item{{ID: a.ID, Name: "a", Owner: "bob"}, {Name: "b"}}
+	if err := db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&items).Error; err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if items[0].ResourceVersion != 2 || items[1].ResourceVersion != 3 {
+		t.Errorf("upserted items at versions %d and %d, want 2 and 3", items[0].ResourceVersion, items[1].ResourceVersion)
+	}
+
+	checkLog(t, w, []wantItemEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+		{event.EventActionUpdate, 2, 1, 1, "a"},
+		{event.EventActionCreate, 3, 3, 0, "b"},
+	})
+	if got := versions(t, db); got["a"] != 2 || got["b"] != 3 {
+		t.Errorf("rows at versions %v, want a at 2 and b at 3", got)
+	}
+}
+
+func TestPluginUpsertDoNothing(t *testing.T) {
+	db, w := newSQLiteRelay(t)
+
+	a := &Item{Name: "a", Owner: "alice"}
+	if err := db.Create(a).Error; err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// The first item exists by primary key and the last conflicts on its
+	// name; only the second is inserted.
+	items := []*Item{{ID: a.ID, Name: "a", Owner: "bob"}, {Name: "b"}, {Name: "a", Owner: "carol"}}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&items).Error; err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if items[0].ResourceVersion != 1 || items[1].ResourceVersion != 2 || items[2].ResourceVersion != 0 {
+		t.Errorf("items at versions %d, %d and %d, want 1, 2 and 0",
+			items[0].ResourceVersion, items[1].ResourceVersion, items[2].ResourceVersion)
+	}
+
+	// The revision allocated to the item left out is logged as a gap, so a
+	// watch goes on without waiting for it.
+	wt := wr.Watch[*Item](w, context.Background(), nil, 1)
+	defer wt.Stop()
+	if err := db.Create(&Item{Name: "c"}).Error; err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	events := receive(t, wt, 3)
+	if events[1].Revision != 2 || events[2].Revision != 4 {
+		t.Errorf("watched revisions %d and %d, want 2 and 4", events[1].Revision, events[2].Revision)
+	}
+
+	var gaps int64
+	if err := db.Table("watchrelay").Where("revision = ? AND created = ? AND deleted = ?", 3, true, true).Count(&gaps).Error; err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if gaps != 1 {
+		t.Errorf("revision 3 is not logged as a gap")
+	}
+
+	checkLog(t, w, []wantItemEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+		{event.EventActionCreate, 2, 2, 0, "b"},
+		{event.EventActionCreate, 4, 4, 0, "c"},
+	})
+}
+
+func TestPluginSave(t *testing.T) {
+	db, w := newSQLiteRelay(t)
+
+	a := &Item{Name: "a", Owner: "alice"}
+	if err := db.Save(a).Error; err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	a.Owner = "bob"
+	if err := db.Save(a).Error; err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if a.ResourceVersion != 2 {
+		t.Errorf("saved item at version %d, want 2", a.ResourceVersion)
+	}
+
+	checkLog(t, w, []wantItemEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+		{event.EventActionUpdate, 2, 1, 1, "a"},
+	})
+	if got := versions(t, db); got["a"] != 2 {
+		t.Errorf("rows at versions %v, want a at 2", got)
+	}
+}
+
+func TestPluginModelUpdates(t *testing.T) {
+	db, w := newSQLiteRelay(t)
+
+	a := &Item{Name: "a", Owner: "alice"}
+	if err := db.Create(a).Error; err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := db.Model(a).Updates(Item{Owner: "bob"}).Error; err != nil {
+		t.Fatalf("Updates: %v", err)
+	}
+	if a.ResourceVersion != 2 {
+		t.Errorf("updated item at version %d, want 2", a.ResourceVersion)
+	}
+
+	checkLog(t, w, []wantItemEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+		{event.EventActionUpdate, 2, 1, 1, "a"},
+	})
+	_, events, err := wr.After[*Item](w, context.Background(), nil, 1, 0)
+	if err != nil {
+		t.Fatalf("After: %v", err)
+	}
+	if owner := events[0].Value.Owner; owner != "bob" {
+		t.Errorf("update event has owner %q, want bob", owner)
+	}
+}
+
+func TestPluginUpdatesWhere(t *testing.T) {
+	db, w := newSQLiteRelay(t)
+
+	items := []*Item{{Name: "a", Owner: "alice"}, {Name: "b", Owner: "alice"}, {Name: "c", Owner: "bob"}}
+	if err := db.Create(&items).Error; err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := db.Model(&Item{}).Where("owner = ?", "alice").Updates(map[string]any{"owner": "carol"}).Error; err != nil {
+		t.Fatalf("Updates: %v", err)
+	}
+
+	checkLog(t, w, []wantItemEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+		{event.EventActionCreate, 2, 2, 0, "b"},
+		{event.EventActionCreate, 3, 3, 0, "c"},
+		{event.EventActionUpdate, 4, 1, 1, "a"},
+		{event.EventActionUpdate, 5, 2, 2, "b"},
+	})
+	if got := versions(t, db); got["a"] != 4 || got["b"] != 5 || got["c"] != 3 {
+		t.Errorf("rows at versions %v, want a at 4, b at 5 and c at 3", got)
+	}
+}
@@ -4,79 +4,306 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/hunknownz/watchrelay/event"
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/metrics"
 	"github.com/hunknownz/watchrelay/resource"
 )
 
+// ErrEvicted is the reason a subscriber is closed with when it does not keep
+// up with the events.
+var ErrEvicted = errors.New("watchrelay: watcher evicted for falling behind")
+
+// ErrClosed is the reason subscribers are closed with when the event stream
+// ends, e.g. when the relay is stopped.
+var ErrClosed = errors.New("watchrelay: event stream closed")
+
+const (
+	defaultBufferSize   = 128
+	defaultBlockTimeout = 5 * time.Second
+)
+
+// Policy decides what happens when a subscriber's buffer is full.
+type Policy int
+
+const (
+	// PolicyDrop closes the subscriber with ErrEvicted.
+	PolicyDrop Policy = iota
+	// PolicyBlock blocks the broadcast until the subscriber has room, closing
+	// it with ErrEvicted if it has none before the block timeout.
+	PolicyBlock
+	// PolicyCoalesce merges the buffered events into a single batch keeping
+	// only the latest event of every object.
+	PolicyCoalesce
+	// PolicySpill drops the events and marks the subscriber as lagging, for
+	// it to catch up from the event log.
+	PolicySpill
+)
+
+// SubscribeOptions configures a subscriber.
+type SubscribeOptions struct {
+	// BufferSize is the number of batches buffered, 128 if zero.
+	BufferSize int
+	Policy     Policy
+	// BlockTimeout bounds the wait of PolicyBlock, 5s if zero.
+	BlockTimeout time.Duration
+}
+
 type Publisher struct {
 	sync.Map
 
+	logger  logging.Logger
+	metrics *metrics.Metrics
+	nextID  uint64
+
+	mu      sync.Mutex
 	running bool
 }
 
+// New returns a Publisher logging to logger and collecting metrics in m, which
+// may be nil. The zero Publisher discards its logs.
+func New(logger logging.Logger, m *metrics.Metrics) *Publisher {
+	return &Publisher{logger: logger, metrics: m}
+}
+
+func (p *Publisher) log() logging.Logger {
+	if p.logger == nil {
+		return logging.Discard()
+	}
+	return p.logger
+}
+
 type ISubscriber interface {
-	Close()
+	Close(err error)
 	Send(pub *Publisher, events []event.IEvent, resourceName string) bool
 }
 
-type Subscriber[T resource.IVersionedResource] chan []*event.Event[T]
+// Subscriber receives the events of a resource until it is closed.
+type Subscriber[T resource.IVersionedResource] struct {
+	id           uint64
+	resourceName string
+	log          logging.Logger
+	metrics      *metrics.Metrics
+	ch           chan []*event.Event[T]
+	done         chan struct{}
+	ctxDone      <-chan struct{}
+	lag          chan struct{}
+	opts         SubscribeOptions
+
+	mu      sync.Mutex
+	closed  bool
+	lagging bool
+	err     error
+}
 
-func (s Subscriber[T]) Close() {
-	close(s)
+// ID returns the ID of the subscriber, unique within its Publisher.
+func (s *Subscriber[T]) ID() uint64 {
+	return s.id
 }
 
-func (s Subscriber[T]) Send(pub *Publisher, iEvents []event.IEvent, resourceName string) bool {
+// C returns the channel of events, closed when the subscriber is closed.
+func (s *Subscriber[T]) C() <-chan []*event.Event[T] {
+	return s.ch
+}
+
+// Err returns why the subscriber was closed.
+func (s *Subscriber[T]) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Done returns a channel that is closed when the subscriber is closed.
+func (s *Subscriber[T]) Done() <-chan struct{} {
+	return s.done
+}
+
+// Lag returns a channel receiving a value when the subscriber starts lagging
+// with PolicySpill. Events are dropped until Resume is called.
+func (s *Subscriber[T]) Lag() <-chan struct{} {
+	return s.lag
+}
+
+// Resume ends the lagging of the subscriber. It is meant to be called once
+// its buffer has been drained, before catching up with the dropped events.
+func (s *Subscriber[T]) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lagging = false
+}
+
+func (s *Subscriber[T]) Close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close(err)
+}
+
+func (s *Subscriber[T]) close(err error) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	s.metrics.SubscriberRemoved(s.resourceName, errors.Is(err, ErrEvicted))
+	close(s.ch)
+	close(s.done)
+}
+
+func (s *Subscriber[T]) Send(pub *Publisher, iEvents []event.IEvent, resourceName string) bool {
 	events, ok := filter[T](iEvents, resourceName)
 	if !ok {
 		return true
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.lagging {
+		return true
+	}
+
 	select {
-	case s <- events:
+	case s.ch <- events:
+		return true
 	default:
-		// drop slow subscriber
-		pub.unsubscribe(s)
 	}
+
+	switch s.opts.Policy {
+	case PolicyBlock:
+		timer := time.NewTimer(s.opts.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case s.ch <- events:
+			return true
+		case <-s.ctxDone:
+			return true
+		case <-timer.C:
+		}
+	case PolicyCoalesce:
+		// The subscriber is the only sender, so the buffer has room once
+		// drained, even if its consumer reads concurrently.
+		var batches [][]*event.Event[T]
+		for drained := false; !drained; {
+			select {
+			case batch := <-s.ch:
+				batches = append(batches, batch)
+			default:
+				drained = true
+			}
+		}
+		s.ch <- coalesce(append(batches, events))
+		return true
+	case PolicySpill:
+		s.lagging = true
+		s.log.Debug("watchrelay: subscriber lagging, spilling events", logging.KeyRevision, events[0].Revision)
+		select {
+		case s.lag <- struct{}{}:
+		default:
+		}
+		return true
+	}
+
+	// drop slow subscriber
+	s.log.Warn("watchrelay: evicting slow subscriber", logging.KeyRevision, events[0].Revision)
+	pub.Delete(s)
+	s.close(ErrEvicted)
 	return true
 }
 
-func Subscribe[T resource.IVersionedResource](pub *Publisher, ctx context.Context, establish func() (chan []event.IEvent, error)) (sub <-chan []*event.Event[T], err error) {
+// coalesce merges batches of events, keeping the latest event of every
+// object, identified by its create revision, in revision order.
+func coalesce[T resource.IVersionedResource](batches [][]*event.Event[T]) []*event.Event[T] {
+	latest := make(map[uint64]int)
+	var merged []*event.Event[T]
+	for _, batch := range batches {
+		for _, e := range batch {
+			if i, ok := latest[e.CreateRevision]; ok {
+				merged[i] = nil
+			}
+			latest[e.CreateRevision] = len(merged)
+			merged = append(merged, e)
+		}
+	}
+
+	coalesced := make([]*event.Event[T], 0, len(latest))
+	for _, e := range merged {
+		if e != nil {
+			coalesced = append(coalesced, e)
+		}
+	}
+	return coalesced
+}
+
+// Subscribe adds a subscriber to the events of T broadcast by pub. ErrClosed
+// is returned if the event stream is not running.
+func Subscribe[T resource.IVersionedResource](pub *Publisher, ctx context.Context, opts SubscribeOptions) (*Subscriber[T], error) {
 	if pub == nil {
 		return nil, errors.New("watchrelay: Publisher is nil")
-
 	}
 
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+
 	if !pub.running {
-		err = pub.start(establish)
-		if err != nil {
-			return nil, err
-		}
+		return nil, ErrClosed
+	}
+
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultBufferSize
+	}
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = defaultBlockTimeout
 	}
 
 	var v T
-	subscriber := make(Subscriber[T], 128)
-	sub = subscriber
 	resourceName := resource.GetResourceName(v)
+	pub.nextID++
+	subscriber := &Subscriber[T]{
+		id:           pub.nextID,
+		resourceName: resourceName,
+		log:          pub.log().With(logging.KeyResource, resourceName, logging.KeySubscriber, pub.nextID),
+		metrics:      pub.metrics,
+		ch:           make(chan []*event.Event[T], opts.BufferSize),
+		done:         make(chan struct{}),
+		ctxDone:      ctx.Done(),
+		lag:          make(chan struct{}, 1),
+		opts:         opts,
+	}
 	pub.Store(ISubscriber(subscriber), resourceName)
+	pub.metrics.SubscriberAdded(resourceName)
+	subscriber.log.Debug("watchrelay: subscribed")
 	go func() {
-		<-ctx.Done()
-		pub.unsubscribe(subscriber)
+		select {
+		case <-ctx.Done():
+			pub.unsubscribe(subscriber, ctx.Err())
+		case <-subscriber.done:
+		}
 	}()
 
-	return sub, nil
+	return subscriber, nil
 }
 
-func (p *Publisher) start(establish func() (chan []event.IEvent, error)) error {
-	ch, err := establish()
-	if err != nil {
-		return err
+// Start broadcasts the events received from ch until it is closed, when the
+// subscribers are closed with ErrClosed.
+func (p *Publisher) Start(ch <-chan []event.IEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running {
+		return
 	}
-
-	go p.broadcast(ch)
 	p.running = true
+	p.log().Debug("watchrelay: event stream started")
+	go p.broadcast(ch)
+}
 
-	return nil
+// CloseAll closes the current subscribers with err, leaving the event stream
+// running for new subscribers.
+func (p *Publisher) CloseAll(err error) {
+	p.Range(func(key, _ interface{}) bool {
+		p.unsubscribe(key.(ISubscriber), err)
+		return true
+	})
 }
 
 func filter[T resource.IVersionedResource](events []event.IEvent, resourceName string) ([]*event.Event[T], bool) {
@@ -89,21 +316,24 @@ func filter[T resource.IVersionedResource](events []event.IEvent, resourceName s
 	return filtered, len(filtered) > 0
 }
 
-func (p *Publisher) broadcast(ch chan []event.IEvent) {
+func (p *Publisher) broadcast(ch <-chan []event.IEvent) {
 	for events := range ch {
 		p.Range(func(key, value interface{}) bool {
 			sub := key.(ISubscriber)
 			return sub.Send(p, events, value.(string))
 		})
 	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running = false
+	p.log().Debug("watchrelay: event stream ended, closing subscribers")
+	p.CloseAll(ErrClosed)
 }
 
-func (p *Publisher) unsubscribe(key ISubscriber) {
-	_, ok := p.Load(key)
-	if !ok {
+func (p *Publisher) unsubscribe(key ISubscriber, err error) {
+	if _, ok := p.LoadAndDelete(key); !ok {
 		return
 	}
-
-	key.Close()
-	p.Delete(key)
+	key.Close(err)
 }
@@ -0,0 +1,178 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hunknownz/watchrelay/event"
+	"github.com/hunknownz/watchrelay/resource"
+)
+
+type item struct {
+	resource.Meta
+}
+
+// start returns a running Publisher and a function broadcasting a batch of
+// events of items, identified by their create and current revisions. The
+// function returns once the batch has been sent to the subscribers.
+func start(t *testing.T) (*Publisher, func(revisions ...[2]uint64)) {
+	t.Helper()
+
+	pub := New(nil, nil)
+	ch := make(chan []event.IEvent)
+	pub.Start(ch)
+	t.Cleanup(func() { close(ch) })
+
+	return pub, func(revisions ...[2]uint64) {
+		batch := make([]event.IEvent, len(revisions))
+		for i, rev := range revisions {
+			batch[i] = &event.Event[*item]{
+				CreateRevision: rev[0],
+				Revision:       rev[1],
+				ResourceName:   "item",
+				Action:         event.EventActionUpdate,
+			}
+		}
+		ch <- batch
+		// The broadcast only receives the next batch once done with this one.
+		ch <- nil
+	}
+}
+
+func subscribe(t *testing.T, pub *Publisher, opts SubscribeOptions) *Subscriber[*item] {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	sub, err := Subscribe[*item](pub, ctx, opts)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	return sub
+}
+
+// revisions returns the revisions of the batches buffered by sub.
+func revisions(sub *Subscriber[*item]) [][]uint64 {
+	var revs [][]uint64
+	for {
+		select {
+		case batch, ok := <-sub.C():
+			if !ok {
+				return revs
+			}
+			var r []uint64
+			for _, e := range batch {
+				r = append(r, e.Revision)
+			}
+			revs = append(revs, r)
+		default:
+			return revs
+		}
+	}
+}
+
+func checkRevisions(t *testing.T, got [][]uint64, want ...[]uint64) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("received batches %v, want %v", got, want)
+	}
+	for i := range want {
+		if len(got[i]) != len(want[i]) {
+			t.Fatalf("received batches %v, want %v", got, want)
+		}
+		for j := range want[i] {
+			if got[i][j] != want[i][j] {
+				t.Fatalf("received batches %v, want %v", got, want)
+			}
+		}
+	}
+}
+
+func TestSubscribeNotStarted(t *testing.T) {
+	if _, err := Subscribe[*item](New(nil, nil), context.Background(), SubscribeOptions{}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Subscribe returned %v, want ErrClosed", err)
+	}
+}
+
+func TestPolicyBlock(t *testing.T) {
+	pub, send := start(t)
+	sub := subscribe(t, pub, SubscribeOptions{BufferSize: 1, Policy: PolicyBlock, BlockTimeout: time.Second})
+
+	// The broadcast waits for the consumer to make room.
+	send([2]uint64{1, 1})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-sub.C()
+	}()
+	send([2]uint64{2, 2})
+	checkRevisions(t, revisions(sub), []uint64{2})
+	if err := sub.Err(); err != nil {
+		t.Fatalf("subscriber closed with %v", err)
+	}
+}
+
+func TestPolicyBlockTimeout(t *testing.T) {
+	pub, send := start(t)
+	sub := subscribe(t, pub, SubscribeOptions{BufferSize: 1, Policy: PolicyBlock, BlockTimeout: 50 * time.Millisecond})
+
+	send([2]uint64{1, 1})
+	begin := time.Now()
+	send([2]uint64{2, 2})
+	if elapsed := time.Since(begin); elapsed < 50*time.Millisecond {
+		t.Errorf("broadcast blocked for %v, want the block timeout", elapsed)
+	}
+
+	select {
+	case <-sub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("subscriber not closed after the block timeout")
+	}
+	if err := sub.Err(); !errors.Is(err, ErrEvicted) {
+		t.Fatalf("subscriber closed with %v, want ErrEvicted", err)
+	}
+	checkRevisions(t, revisions(sub), []uint64{1})
+}
+
+func TestPolicyCoalesce(t *testing.T) {
+	pub, send := start(t)
+	sub := subscribe(t, pub, SubscribeOptions{BufferSize: 1, Policy: PolicyCoalesce})
+
+	send([2]uint64{1, 1}, [2]uint64{2, 2})
+	send([2]uint64{1, 3}, [2]uint64{4, 4})
+	send([2]uint64{4, 5})
+
+	// Only the latest event of every object is kept, in revision order.
+	checkRevisions(t, revisions(sub), []uint64{2, 3, 5})
+	if err := sub.Err(); err != nil {
+		t.Fatalf("subscriber closed with %v", err)
+	}
+}
+
+func TestPolicySpill(t *testing.T) {
+	pub, send := start(t)
+	sub := subscribe(t, pub, SubscribeOptions{BufferSize: 1, Policy: PolicySpill})
+
+	send([2]uint64{1, 1})
+	send([2]uint64{2, 2})
+	select {
+	case <-sub.Lag():
+	default:
+		t.Fatal("subscriber not lagging with a full buffer")
+	}
+
+	// Events are dropped until the subscriber resumes.
+	send([2]uint64{3, 3})
+	checkRevisions(t, revisions(sub), []uint64{1})
+	send([2]uint64{4, 4})
+	checkRevisions(t, revisions(sub))
+
+	sub.Resume()
+	send([2]uint64{5, 5})
+	checkRevisions(t, revisions(sub), []uint64{5})
+	if err := sub.Err(); err != nil {
+		t.Fatalf("subscriber closed with %v", err)
+	}
+}
@@ -46,3 +46,11 @@ func GetResourceName(resource IVersionedResource) string {
 	// 获取类型名称并转换为snake case
 	return toSnakeCase(t.Name())
 }
+
+// IKeyedResource is an interface that represents a versioned resource with an identity.
+type IKeyedResource interface {
+	IVersionedResource
+	// GetResourceKey returns the primary key of the resource. The values of
+	// composite primary keys are joined by "/" in field order, e.g. "namespace/name".
+	GetResourceKey() string
+}
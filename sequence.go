@@ -1,6 +1,11 @@
 package watchrelay
 
-import "sync/atomic"
+import (
+	"context"
+	"sync/atomic"
+
+	"gorm.io/gorm"
+)
 
 // Sequence is a simple counter that can be used to generate unique IDs.
 type Sequence struct {
@@ -21,3 +26,9 @@ func (s *Sequence) Next() uint64 {
 func (s *Sequence) Current() uint64 {
 	return atomic.LoadUint64(&s.value)
 }
+
+// Allocate implements RevisionAllocator. The sequence only lives in process,
+// so it is not safe to share the event log with other writer processes.
+func (s *Sequence) Allocate(ctx context.Context, tx *gorm.DB) (uint64, error) {
+	return s.Next(), nil
+}
@@ -0,0 +1,77 @@
+package sqllog
+
+import (
+	"time"
+
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/metrics"
+	"github.com/hunknownz/watchrelay/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultTableName     = "watchrelay"
+	DefaultPollInterval  = time.Second
+	DefaultPollBatchSize = 512
+	DefaultBufferSize    = 128
+)
+
+// Clock tells the time of events and timeouts.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Config tunes a SQLLog and the dialect storing its event log. Zero values
+// select the defaults.
+type Config struct {
+	// TableName is the table of the event log.
+	TableName string
+	// PollInterval is how often the log is polled for new events.
+	PollInterval time.Duration
+	// PollBatchSize is the maximum number of events read by a poll.
+	PollBatchSize int64
+	// BufferSize is the default number of batches buffered for a watch.
+	BufferSize int
+	Clock      Clock
+	Logger     logging.Logger
+	// Metrics collects the metrics of the log, if not nil.
+	Metrics *metrics.Metrics
+	// Tracer traces the polls of the log. Wrap the dialect with Traced to
+	// trace its queries as well.
+	Tracer tracing.Tracer
+	// Propagator persists the trace context of writers with their events,
+	// if not nil.
+	Propagator tracing.Propagator
+}
+
+// WithDefaults returns the config with its zero values set to the defaults.
+func (c Config) WithDefaults() Config {
+	if c.TableName == "" {
+		c.TableName = DefaultTableName
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = DefaultPollInterval
+	}
+	if c.PollBatchSize <= 0 {
+		c.PollBatchSize = DefaultPollBatchSize
+	}
+	if c.BufferSize <= 0 {
+		c.BufferSize = DefaultBufferSize
+	}
+	if c.Clock == nil {
+		c.Clock = realClock{}
+	}
+	if c.Tracer == nil {
+		c.Tracer = tracing.Noop()
+	}
+	if c.Logger == nil {
+		c.Logger = logging.NewLogrus(logrus.StandardLogger())
+	}
+	return c
+}
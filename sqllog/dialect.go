@@ -2,13 +2,46 @@ package sqllog
 
 import (
 	"context"
-	"database/sql"
 	"time"
+
+	"github.com/hunknownz/watchrelay/event"
 )
 
+// Rows is the result of a log query. It is satisfied by *sql.Rows.
+type Rows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+	Close() error
+}
+
 type Dialect interface {
-	After(ctx context.Context, resourceName string, revision uint64, limit int64) (*sql.Rows, error)
+	// After returns the events after revision, of resourceName or of all
+	// resources if it is empty. The value of the previous event is NULL.
+	After(ctx context.Context, resourceName string, revision uint64, limit int64) (Rows, error)
+	// AfterWithPrev is After reading the value of the previous event of every
+	// event as well.
+	AfterWithPrev(ctx context.Context, resourceName string, revision uint64, limit int64) (Rows, error)
+	// ClearExpiredEvents compacts the events older than dur, keeping the
+	// newest event of every object, and returns the number of deleted events.
 	ClearExpiredEvents(ctx context.Context, dur time.Duration) (int, error)
+	// CompactRevision returns the revision the log has been compacted up to.
+	CompactRevision(ctx context.Context) (uint64, error)
 	CurrentRevision(ctx context.Context) (uint64, error)
 	FillGap(ctx context.Context, revision uint64, resourceName string) error
+	// List returns the newest event at or below revision of every object of
+	// resourceName, in the columns of After, including the delete events of
+	// the objects deleted at revision. Objects are ordered by create
+	// revision, starting after after, and limit bounds their number.
+	List(ctx context.Context, resourceName string, revision, after uint64, limit int64) (Rows, error)
+}
+
+// Store is a Dialect that keeps the event log itself instead of sharing a
+// database with gorm, so log events are appended to it directly.
+type Store interface {
+	Dialect
+	Append(ctx context.Context, events ...*event.LogEvent) error
+	// Get returns the events at the given revisions, leaving out the
+	// revisions without an event.
+	Get(ctx context.Context, revisions ...uint64) ([]*event.LogEvent, error)
 }
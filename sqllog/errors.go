@@ -0,0 +1,71 @@
+package sqllog
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCompacted is returned when the requested revision has been compacted
+// and the events after it are no longer complete. Callers should list the
+// current state again instead of resuming from the revision.
+var ErrCompacted = errors.New("watchrelay: revision has been compacted")
+
+// CompactedError is the ErrCompacted returned for a specific revision.
+type CompactedError struct {
+	Revision        uint64
+	CompactRevision uint64
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("watchrelay: revision %d has been compacted, compact revision is %d", e.Revision, e.CompactRevision)
+}
+
+func (e *CompactedError) Is(target error) bool {
+	return target == ErrCompacted
+}
+
+// ErrConflict is returned when a resource is written from a resource version
+// that is no longer its current version.
+var ErrConflict = errors.New("watchrelay: resource version conflict")
+
+// ErrNotFound is returned when a resource does not exist.
+var ErrNotFound = errors.New("watchrelay: resource not found")
+
+// ConflictError is the ErrConflict returned for a specific write.
+type ConflictError struct {
+	Revision        uint64
+	CurrentRevision uint64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("watchrelay: resource version %d conflicts with current version %d", e.Revision, e.CurrentRevision)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// ErrNotStarted is returned by reads and watches of a relay that has not
+// been started.
+var ErrNotStarted = errors.New("watchrelay: relay not started")
+
+// ErrDatabase is reported to watchers when the event log could not be polled
+// for a while, as the database kept failing.
+var ErrDatabase = errors.New("watchrelay: database unavailable")
+
+// DatabaseError is the ErrDatabase wrapping the last error of the database.
+type DatabaseError struct {
+	Err error
+}
+
+func (e *DatabaseError) Error() string {
+	return fmt.Sprintf("watchrelay: database unavailable: %v", e.Err)
+}
+
+func (e *DatabaseError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DatabaseError) Is(target error) bool {
+	return target == ErrDatabase
+}
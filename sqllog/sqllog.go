@@ -2,63 +2,94 @@ package sqllog
 
 import (
 	"context"
-	"database/sql"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hunknownz/watchrelay/event"
+	"github.com/hunknownz/watchrelay/logging"
 	"github.com/hunknownz/watchrelay/publisher"
 	"github.com/hunknownz/watchrelay/resource"
-	"github.com/sirupsen/logrus"
+	"github.com/hunknownz/watchrelay/tracing"
 )
 
-const (
-	pollBatchSize = 512
-	pollInterval  = time.Second
-)
+// gapTimeout is how long the poller waits for a missing revision to be
+// committed before filling it with a gap.
+const gapTimeout = time.Second
+
+// maxPollFailures is the number of polls in a row the database may fail
+// before the subscribers are closed with a *DatabaseError.
+const maxPollFailures = 5
 
 type SQLLog struct {
 	d          Dialect
+	cfg        Config
 	ctx        context.Context
 	currentRev uint64
 	pub        *publisher.Publisher
 	notify     chan uint64
 
+	// skip is the first revision the poller is waiting for since skipTime,
+	// before filling it with a gap.
+	skip     uint64
+	skipTime time.Time
+	// prevWatches counts the subscribers asking for the values of the
+	// previous events, which are only polled while there are some.
+	prevWatches atomic.Int64
+
+	// revMu guards ctx, currentRev and polling for readers other than the
+	// poller. advanced is closed and replaced whenever they change.
+	revMu    sync.Mutex
+	polling  bool
+	advanced chan struct{}
+
 	fMutex       sync.Mutex
 	eventFuncMap map[string]event.EventFunc
 }
 
-func NewSQLLog(d Dialect) *SQLLog {
+// NewSQLLog returns the log of d, to be polled from startRev, the newest
+// revision of the log once its writers have committed.
+func NewSQLLog(d Dialect, cfg Config, startRev uint64) *SQLLog {
+	cfg = cfg.WithDefaults()
 	l := &SQLLog{
 		d:            d,
+		cfg:          cfg,
+		currentRev:   startRev,
 		notify:       make(chan uint64, 1024),
+		advanced:     make(chan struct{}),
 		eventFuncMap: make(map[string]event.EventFunc),
-		pub:          &publisher.Publisher{},
+		pub:          publisher.New(cfg.Logger, cfg.Metrics),
 	}
 	return l
 }
 
-func (s *SQLLog) FillGap(resourceName string, revision uint64) {
-	ctx, cancel := context.WithCancel(s.ctx)
-	go func() {
-		for {
-			select {
-			case <-s.ctx.Done():
-				cancel()
-				return
-			default:
-				err := s.d.FillGap(ctx, revision, resourceName)
-				if err == nil {
-					return
-				}
-				logrus.Errorf("watchrelay: failed to fill gap %d: %v", revision, err)
-			}
-		}
-	}()
+// FillGap inserts a gap marker for a revision that was allocated but never
+// committed. It succeeds if the revision has been committed meanwhile.
+func (s *SQLLog) FillGap(resourceName string, revision uint64) error {
+	return s.d.FillGap(s.ctx, revision, resourceName)
 }
 
+// Start polls the log for new events until ctx is done.
 func (s *SQLLog) Start(ctx context.Context) {
-	s.ctx = ctx
+	s.revMu.Lock()
+	if s.ctx != nil {
+		s.revMu.Unlock()
+		return
+	}
+	s.ctx, s.polling = ctx, true
+	s.advance()
+	s.revMu.Unlock()
+
+	ch := make(chan []event.IEvent)
+	go s.poll(ch)
+	s.pub.Start(ch)
+}
+
+// started reports whether Start has been called.
+func (s *SQLLog) started() bool {
+	s.revMu.Lock()
+	defer s.revMu.Unlock()
+	return s.ctx != nil
 }
 
 func (s *SQLLog) IsRegisterd(resourceName string) bool {
@@ -72,23 +103,31 @@ func (s *SQLLog) Register(resourceName string, fn event.EventFunc) {
 	s.eventFuncMap[resourceName] = fn
 }
 
-func (s *SQLLog) RowsToEvents(rows *sql.Rows) (rev uint64, events []event.IEvent, err error) {
+func (s *SQLLog) RowsToEvents(rows Rows) (rev uint64, events []event.IEvent, err error) {
 	defer rows.Close()
 
 	for rows.Next() {
 		var (
-			revision, createRevision uint64
-			created, deleted         bool
-			resourceName             string
-			value                    []byte
-			createdAt                time.Time
+			revision, createRevision, prevRevision uint64
+			created, deleted                       bool
+			resourceName                           string
+			value, prevValue                       []byte
+			traceContext, annotations              []byte
+			createdAt                              time.Time
 		)
-		if err := rows.Scan(&rev, &revision, &createRevision, &resourceName, &created, &deleted, &value, &createdAt); err != nil {
+		if err := rows.Scan(&rev, &revision, &createRevision, &resourceName, &created, &deleted, &value, &createdAt, &prevRevision, &prevValue, &traceContext, &annotations); err != nil {
 			return 0, nil, err
 		}
 
+		// Rows that are not delivered still take up their revision, so that
+		// the poller can tell them from revisions that are not committed yet.
+		gap := &event.Gap{Revision: revision, CreatedAt: createdAt}
+
 		var action event.EventAction
-		if created {
+		if created && deleted {
+			events = append(events, gap)
+			continue
+		} else if created {
 			action = event.EventActionCreate
 		} else if deleted {
 			action = event.EventActionDelete
@@ -97,13 +136,15 @@ func (s *SQLLog) RowsToEvents(rows *sql.Rows) (rev uint64, events []event.IEvent
 		}
 		generateFunc, ok := s.eventFuncMap[resourceName]
 		if !ok {
-			logrus.Errorf("watchrelay: no event function for resource %s", resourceName)
+			s.cfg.Logger.Debug("watchrelay: no event function for resource", logging.KeyResource, resourceName, logging.KeyRevision, revision)
+			events = append(events, gap)
 			continue
 		}
 
-		event, err := generateFunc(revision, createRevision, action, createdAt, value)
+		event, err := generateFunc(revision, createRevision, prevRevision, action, createdAt, value, prevValue, traceContext, annotations)
 		if err != nil {
-			logrus.Errorf("watchrelay: failed to generate event: %v", err)
+			s.cfg.Logger.Error("watchrelay: failed to generate event", logging.KeyResource, resourceName, logging.KeyRevision, revision, logging.KeyError, err)
+			events = append(events, gap)
 			continue
 		}
 		events = append(events, event)
@@ -115,61 +156,175 @@ func (s *SQLLog) RowsToEvents(rows *sql.Rows) (rev uint64, events []event.IEvent
 	return rev, events, nil
 }
 
-func (s *SQLLog) After(ctx context.Context, resourceName string, revision uint64, limit int64) (rev uint64, events []event.IEvent, err error) {
-	rows, afterErr := s.d.After(ctx, resourceName, revision, limit)
+// AfterOptions configures a read of the events after a revision.
+type AfterOptions struct {
+	// Limit bounds the number of events read, zero reading all of them.
+	Limit int64
+	// FromOldest reads from the oldest event kept when the revision has been
+	// compacted, instead of returning a *CompactedError. It is meant for reads
+	// from revision 0 that start with whatever history is left.
+	FromOldest bool
+	// PrevValue reads the values of the previous events, for
+	// event.Event.WithPrevValue.
+	PrevValue bool
+}
+
+// After returns the events after revision. A *CompactedError is returned if
+// events after revision have been compacted, unless reading from the oldest
+// event kept.
+func (s *SQLLog) After(ctx context.Context, resourceName string, revision uint64, opts AfterOptions) (rev uint64, events []event.IEvent, err error) {
+	after := s.d.After
+	if opts.PrevValue {
+		after = s.d.AfterWithPrev
+	}
+	rows, afterErr := after(ctx, resourceName, revision, opts.Limit)
 	if afterErr != nil {
 		err = afterErr
 		return
 	}
-	return s.RowsToEvents(rows)
+	rev, events, err = s.RowsToEvents(rows)
+	if err != nil || opts.FromOldest {
+		return
+	}
+
+	// Checked after reading, so that a compaction running concurrently with
+	// the query cannot go unnoticed.
+	compactRev, err := s.d.CompactRevision(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if revision < compactRev {
+		return 0, nil, &CompactedError{Revision: revision, CompactRevision: compactRev}
+	}
+	return
 }
 
-type EventFilter[T resource.IVersionedResource] func([]*event.Event[T]) ([]*event.Event[T], bool)
+// List returns the newest event at or below revision of every object of
+// resourceName, ordered by create revision and starting after the create
+// revision after. Objects deleted at revision are listed with their delete
+// event, for a limited list to continue after them. A *CompactedError is
+// returned if the state at revision has been compacted.
+func (s *SQLLog) List(ctx context.Context, resourceName string, revision, after uint64, limit int64) ([]event.IEvent, error) {
+	rows, err := s.d.List(ctx, resourceName, revision, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	_, events, err := s.RowsToEvents(rows)
+	if err != nil {
+		return nil, err
+	}
 
-func Watch[T resource.IVersionedResource](sl *SQLLog, ctx context.Context, filter EventFilter[T]) <-chan []*event.Event[T] {
-	results := make(chan []*event.Event[T], 128)
-	watchCh, err := publisher.Subscribe[T](sl.pub, ctx, sl.startWatch)
+	compactRev, err := s.d.CompactRevision(ctx)
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	if revision < compactRev {
+		return nil, &CompactedError{Revision: revision, CompactRevision: compactRev}
 	}
+	return events, nil
+}
 
-	go func() {
-		defer close(results)
-		for value := range watchCh {
-			filtered, ok := filter(value)
-			if ok {
-				results <- filtered
-			}
+// WatchOptions configures a subscriber to the polled events.
+type WatchOptions struct {
+	publisher.SubscribeOptions
+	// PrevValue polls the values of the previous events for the subscriber.
+	PrevValue bool
+}
+
+// Watch subscribes to the events of T polled from the log, until ctx is done
+// or the subscriber is closed for another reason reported by its Err.
+// ErrNotStarted is returned before Start.
+func Watch[T resource.IVersionedResource](sl *SQLLog, ctx context.Context, opts WatchOptions) (*publisher.Subscriber[T], error) {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = sl.cfg.BufferSize
+	}
+	if !sl.started() {
+		return nil, ErrNotStarted
+	}
+	if opts.PrevValue {
+		sl.prevWatches.Add(1)
+	}
+	sub, err := publisher.Subscribe[T](sl.pub, ctx, opts.SubscribeOptions)
+	if opts.PrevValue {
+		if err != nil {
+			sl.prevWatches.Add(-1)
+		} else {
+			go func() {
+				<-sub.Done()
+				sl.prevWatches.Add(-1)
+			}()
 		}
-	}()
+	}
+	return sub, err
+}
 
-	return results
+// setCurrentRev records how far the poller has read the log, waking up
+// ConsistentRevision.
+func (s *SQLLog) setCurrentRev(rev uint64) {
+	s.revMu.Lock()
+	defer s.revMu.Unlock()
+	s.currentRev = rev
+	s.advance()
 }
 
-func (s *SQLLog) startWatch() (chan []event.IEvent, error) {
-	startRev, err := s.d.CurrentRevision(s.ctx)
-	if err != nil {
-		return nil, err
-	}
+// stop records that the poller stopped as its context is done.
+func (s *SQLLog) stop() {
+	s.revMu.Lock()
+	defer s.revMu.Unlock()
+	s.polling = false
+	s.advance()
+}
 
-	ch := make(chan []event.IEvent)
-	go s.poll(ch, startRev)
-	return ch, nil
+// advance wakes up the waiters on advanced. revMu must be held.
+func (s *SQLLog) advance() {
+	close(s.advanced)
+	s.advanced = make(chan struct{})
 }
 
-func (s *SQLLog) poll(result chan []event.IEvent, startRev uint64) {
-	s.currentRev = startRev
+// ConsistentRevision returns the newest revision with no uncommitted revision
+// below it. It waits for the poller to have read the log up to the current
+// revision, including the gaps it waits for, and returns the revision the
+// poller is at. ErrNotStarted is returned before Start.
+func (s *SQLLog) ConsistentRevision(ctx context.Context) (uint64, error) {
+	if !s.started() {
+		return 0, ErrNotStarted
+	}
+	target, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case s.notify <- target:
+	default:
+	}
 
-	var (
-		// skip        uint64
-		// skipTime    time.Time
-		waitForMore = true
-	)
+	for {
+		s.revMu.Lock()
+		rev, polling, advanced := s.currentRev, s.polling, s.advanced
+		s.revMu.Unlock()
+		if rev >= target {
+			return rev, nil
+		}
+		if !polling {
+			return 0, publisher.ErrClosed
+		}
 
-	ticker := time.NewTicker(pollInterval)
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (s *SQLLog) poll(result chan []event.IEvent) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
 	defer ticker.Stop()
 	defer close(result)
+	defer s.stop()
 
+	var failures int
+	waitForMore := true
 	for {
 		if waitForMore {
 			select {
@@ -182,50 +337,127 @@ func (s *SQLLog) poll(result chan []event.IEvent, startRev uint64) {
 			case <-ticker.C:
 			}
 		}
-		waitForMore = true
 
-		rows, err := s.d.After(s.ctx, "", s.currentRev, pollBatchSize)
-		if err != nil {
-			logrus.Errorf("watchrelay: failed to list after %d: %v", s.currentRev, err)
+		var err error
+		waitForMore, err = s.pollOnce(result)
+		if err == nil || s.ctx.Err() != nil {
+			failures = 0
 			continue
 		}
-
-		_, events, err := s.RowsToEvents(rows)
-		if err != nil {
-			logrus.Errorf("watchrelay: failed to convert rows to events: %v", err)
-			continue
+		// Polling goes on for new subscribers, but the current ones are
+		// told that their events are late.
+		if failures++; failures >= maxPollFailures {
+			s.cfg.Logger.Error("watchrelay: database keeps failing, closing subscribers", logging.KeyRevision, s.currentRev, logging.KeyError, err)
+			s.pub.CloseAll(&DatabaseError{Err: err})
+			failures = 0
 		}
+	}
+}
 
-		if len(events) == 0 {
-			continue
-		}
+// pollOnce reads a batch of events after the current revision and sends the
+// ones following it without gaps to result. It reports whether to wait before
+// polling again, and the error of the database if it failed.
+func (s *SQLLog) pollOnce(result chan []event.IEvent) (waitForMore bool, err error) {
+	ctx, span := s.cfg.Tracer.Start(s.ctx, "watchrelay.poll", tracing.Attr(tracing.KeyRevision, s.currentRev))
+	defer span.End()
 
-		waitForMore = len(events) < 128
+	after := s.d.After
+	if s.prevWatches.Load() > 0 {
+		after = s.d.AfterWithPrev
+	}
+	start := time.Now()
+	rows, err := after(ctx, "", s.currentRev, s.cfg.PollBatchSize)
+	if err != nil {
+		s.cfg.Logger.Error("watchrelay: failed to list events", logging.KeyRevision, s.currentRev, logging.KeyError, err)
+		span.RecordError(err)
+		return true, err
+	}
 
-		rev := s.currentRev
-		var (
-			seq      []event.IEvent
-			saveLast bool
-		)
+	logRev, events, err := s.RowsToEvents(rows)
+	if err != nil {
+		s.cfg.Logger.Error("watchrelay: failed to convert rows to events", logging.KeyRevision, s.currentRev, logging.KeyError, err)
+		span.RecordError(err)
+		return true, err
+	}
+	defer s.observeRevisions(logRev)
+	s.cfg.Metrics.ObservePoll(time.Since(start), len(events))
+	span.SetAttributes(tracing.Attr(tracing.KeyEvents, len(events)))
+
+	if len(events) == 0 {
+		return true, nil
+	}
 
-		for _, event := range events {
-			next := rev + 1
-			if event.GetRevision() != next {
+	waitForMore = int64(len(events)) < s.cfg.PollBatchSize
+
+	rev := s.currentRev
+	var (
+		seq      []event.IEvent
+		saveLast bool
+	)
 
+	for _, event := range events {
+		next := rev + 1
+		if event.GetRevision() != next {
+			// The revisions up to this event are allocated but not committed,
+			// either because their transactions are still running or because
+			// they were rolled back. Events are only ever delivered in order,
+			// so wait for them for a while before filling them with gaps.
+			waitForMore = true
+			if s.skip != next {
+				s.skip = next
+				s.skipTime = s.cfg.Clock.Now()
+				s.cfg.Logger.Debug("watchrelay: waiting for uncommitted revisions", logging.KeyRevision, next, "until", event.GetRevision()-1)
+				break
+			}
+			if s.cfg.Clock.Now().Sub(s.skipTime) < gapTimeout {
+				break
 			}
 
-			saveLast = true
-			rev = event.GetRevision()
-			if !event.IsGap() {
-				seq = append(seq, event)
+			if err = s.fillGaps(ctx, next, event.GetRevision()); err != nil {
+				s.cfg.Logger.Error("watchrelay: failed to fill gap", logging.KeyRevision, next, logging.KeyError, err)
+				span.RecordError(err)
+				break
 			}
+			// Read the filled revisions back, as a revision may have been
+			// committed just before its gap.
+			waitForMore = false
+			break
 		}
 
-		if saveLast {
-			s.currentRev = rev
-			if len(seq) > 0 {
-				result <- seq
-			}
+		saveLast = true
+		rev = event.GetRevision()
+		if !event.IsGap() {
+			seq = append(seq, event)
+		}
+	}
+
+	if saveLast {
+		s.setCurrentRev(rev)
+		if len(seq) > 0 {
+			result <- seq
+		}
+	}
+	return waitForMore, err
+}
+
+// observeRevisions records how far polling lags behind logRev, the newest
+// revision of the log read along with the events. It is 0 if there were no
+// events after the current revision.
+func (s *SQLLog) observeRevisions(logRev uint64) {
+	if logRev < s.currentRev {
+		logRev = s.currentRev
+	}
+	s.cfg.Metrics.SetRevisions(s.currentRev, logRev)
+}
+
+// fillGaps fills the revisions from start up to but not including end.
+func (s *SQLLog) fillGaps(ctx context.Context, start, end uint64) error {
+	for rev := start; rev < end; rev++ {
+		if err := s.d.FillGap(ctx, rev, ""); err != nil {
+			return err
 		}
+		s.cfg.Logger.Debug("watchrelay: filled gap", logging.KeyRevision, rev)
+		s.cfg.Metrics.GapFilled()
 	}
+	return nil
 }
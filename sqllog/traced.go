@@ -0,0 +1,100 @@
+package sqllog
+
+import (
+	"context"
+	"time"
+
+	"github.com/hunknownz/watchrelay/event"
+	"github.com/hunknownz/watchrelay/tracing"
+)
+
+type tracedDialect struct {
+	Dialect
+	tracer tracing.Tracer
+}
+
+// Traced returns d with a span around each of its queries. A Store stays a
+// Store, so that it can still be appended to.
+func Traced(d Dialect, tracer tracing.Tracer) Dialect {
+	if tracer == nil {
+		return d
+	}
+	td := tracedDialect{Dialect: d, tracer: tracer}
+	if store, ok := d.(Store); ok {
+		return &tracedStore{tracedDialect: td, store: store}
+	}
+	return &td
+}
+
+func (d *tracedDialect) start(ctx context.Context, query string, attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+	return d.tracer.Start(ctx, "watchrelay.dialect."+query, attrs...)
+}
+
+func end(span tracing.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+func (d *tracedDialect) After(ctx context.Context, resourceName string, revision uint64, limit int64) (rows Rows, err error) {
+	ctx, span := d.start(ctx, "After", tracing.Attr(tracing.KeyResource, resourceName), tracing.Attr(tracing.KeyRevision, revision))
+	defer func() { end(span, err) }()
+	return d.Dialect.After(ctx, resourceName, revision, limit)
+}
+
+func (d *tracedDialect) AfterWithPrev(ctx context.Context, resourceName string, revision uint64, limit int64) (rows Rows, err error) {
+	ctx, span := d.start(ctx, "AfterWithPrev", tracing.Attr(tracing.KeyResource, resourceName), tracing.Attr(tracing.KeyRevision, revision))
+	defer func() { end(span, err) }()
+	return d.Dialect.AfterWithPrev(ctx, resourceName, revision, limit)
+}
+
+func (d *tracedDialect) ClearExpiredEvents(ctx context.Context, dur time.Duration) (n int, err error) {
+	ctx, span := d.start(ctx, "ClearExpiredEvents")
+	defer func() {
+		span.SetAttributes(tracing.Attr(tracing.KeyEvents, n))
+		end(span, err)
+	}()
+	return d.Dialect.ClearExpiredEvents(ctx, dur)
+}
+
+func (d *tracedDialect) CompactRevision(ctx context.Context) (rev uint64, err error) {
+	ctx, span := d.start(ctx, "CompactRevision")
+	defer func() { end(span, err) }()
+	return d.Dialect.CompactRevision(ctx)
+}
+
+func (d *tracedDialect) CurrentRevision(ctx context.Context) (rev uint64, err error) {
+	ctx, span := d.start(ctx, "CurrentRevision")
+	defer func() { end(span, err) }()
+	return d.Dialect.CurrentRevision(ctx)
+}
+
+func (d *tracedDialect) FillGap(ctx context.Context, revision uint64, resourceName string) (err error) {
+	ctx, span := d.start(ctx, "FillGap", tracing.Attr(tracing.KeyResource, resourceName), tracing.Attr(tracing.KeyRevision, revision))
+	defer func() { end(span, err) }()
+	return d.Dialect.FillGap(ctx, revision, resourceName)
+}
+
+func (d *tracedDialect) List(ctx context.Context, resourceName string, revision, after uint64, limit int64) (rows Rows, err error) {
+	ctx, span := d.start(ctx, "List", tracing.Attr(tracing.KeyResource, resourceName), tracing.Attr(tracing.KeyRevision, revision))
+	defer func() { end(span, err) }()
+	return d.Dialect.List(ctx, resourceName, revision, after, limit)
+}
+
+type tracedStore struct {
+	tracedDialect
+	store Store
+}
+
+func (s *tracedStore) Append(ctx context.Context, events ...*event.LogEvent) (err error) {
+	ctx, span := s.start(ctx, "Append", tracing.Attr(tracing.KeyEvents, len(events)))
+	defer func() { end(span, err) }()
+	return s.store.Append(ctx, events...)
+}
+
+func (s *tracedStore) Get(ctx context.Context, revisions ...uint64) (events []*event.LogEvent, err error) {
+	ctx, span := s.start(ctx, "Get", tracing.Attr(tracing.KeyEvents, len(revisions)))
+	defer func() { end(span, err) }()
+	return s.store.Get(ctx, revisions...)
+}
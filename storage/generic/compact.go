@@ -0,0 +1,125 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/hunknownz/watchrelay/sqllog"
+)
+
+// compactBatchSize bounds the number of revisions compacted in a single
+// transaction, so that catching up on a large log does not hold locks on it.
+const compactBatchSize = 10000
+
+// Compactor implements log compaction for the SQL dialects. An event is an
+// object's history entry, objects being identified by their create revision.
+//
+// Compacting up to a revision keeps, for every object, its newest event at or
+// below that revision and all events after it, so the state of every object
+// as of the compact revision can still be read. Gap markers and the delete
+// events of objects deleted at or below the compact revision are dropped.
+type Compactor struct {
+	DB    *sql.DB
+	Clock sqllog.Clock
+
+	RevSQL              string
+	ExpiredRevSQL       string
+	CompactRevSQL       string
+	SetCompactRevSQL    string
+	DeleteSupersededSQL string
+	DeleteGapsSQL       string
+	DeleteTombstonesSQL string
+}
+
+// CompactRevision returns the revision the log has been compacted up to.
+func (c *Compactor) CompactRevision(ctx context.Context) (uint64, error) {
+	return queryRevision(ctx, c.DB, c.CompactRevSQL)
+}
+
+// ClearExpiredEvents compacts the log up to the newest revision older than dur
+// and returns the number of deleted events. The newest revision is never
+// compacted so that the current revision does not go backwards.
+func (c *Compactor) ClearExpiredEvents(ctx context.Context, dur time.Duration) (int, error) {
+	target, err := queryRevision(ctx, c.DB, c.ExpiredRevSQL, c.Clock.Now().Add(-dur))
+	if err != nil {
+		return 0, err
+	}
+	current, err := queryRevision(ctx, c.DB, c.RevSQL)
+	if err != nil {
+		return 0, err
+	}
+	if current == 0 {
+		return 0, nil
+	}
+	if target >= current {
+		target = current - 1
+	}
+
+	compactRev, err := c.CompactRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int
+	for compactRev < target {
+		rev := compactRev + compactBatchSize
+		if rev > target {
+			rev = target
+		}
+
+		n, err := c.compact(ctx, rev)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+		compactRev = rev
+	}
+	return deleted, nil
+}
+
+func (c *Compactor) compact(ctx context.Context, rev uint64) (int, error) {
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	superseded, err := execRowsAffected(ctx, tx, c.DeleteSupersededSQL, rev, rev)
+	if err != nil {
+		return 0, err
+	}
+	gaps, err := execRowsAffected(ctx, tx, c.DeleteGapsSQL, rev)
+	if err != nil {
+		return 0, err
+	}
+	tombstones, err := execRowsAffected(ctx, tx, c.DeleteTombstonesSQL, rev)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, c.SetCompactRevSQL, rev, rev); err != nil {
+		return 0, err
+	}
+
+	return int(superseded + gaps + tombstones), tx.Commit()
+}
+
+func execRowsAffected(ctx context.Context, tx *sql.Tx, query string, args ...any) (int64, error) {
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func queryRevision(ctx context.Context, db *sql.DB, query string, args ...any) (uint64, error) {
+	var sqlRev sql.NullInt64
+	err := db.QueryRowContext(ctx, query, args...).Scan(&sqlRev)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if !sqlRev.Valid {
+		return 0, nil
+	}
+	return uint64(sqlRev.Int64), nil
+}
@@ -1,12 +1,134 @@
 package generic
 
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hunknownz/watchrelay/sqllog"
+)
+
 var (
 	RevisionSQL = `
 	SELECT MAX(events.revision) AS current_revision
 	FROM watchrelay AS events`
-	Columns = `
-	log.revision, log.create_revision, log.resource_name, log.created, log.deleted, log.value, log.created_at`
+	// Columns are the columns of the events read from the log. The value of
+	// the previous event is left out, as NULL.
+	Columns = columns("NULL")
+	// PrevColumns are the Columns with the value of the previous event, read
+	// through PrevJoin.
+	PrevColumns = columns("prev.value")
+	// PrevJoin joins the previous event of each event, providing the prev
+	// columns of PrevColumns.
+	PrevJoin = `
+	LEFT JOIN watchrelay AS prev ON prev.revision = log.prev_revision`
 	FillGapSQL = `
 	INSERT INTO watchrelay(revision, resource_name, created, deleted, create_revision, prev_revision, value, created_at)
-	values(?, ?, 1, 1, ?, 0, "", ?)`
+	values(?, ?, TRUE, TRUE, ?, 0, '', ?)`
+	ExpiredRevisionSQL = `
+	SELECT MAX(log.revision)
+	FROM watchrelay AS log
+	WHERE log.created_at < ?`
+	CompactRevisionSQL = `
+	SELECT compaction.revision
+	FROM watchrelay_compaction AS compaction
+	WHERE compaction.id = 1`
+	SetCompactRevisionSQL = `
+	UPDATE watchrelay_compaction
+	SET revision = ?
+	WHERE id = 1 AND revision < ?`
+	DeleteGapsSQL = `
+	DELETE FROM watchrelay
+	WHERE created = TRUE AND deleted = TRUE AND revision <= ?`
+	DeleteTombstonesSQL = `
+	DELETE FROM watchrelay
+	WHERE created = FALSE AND deleted = TRUE AND create_revision > 0 AND revision <= ?`
+)
+
+// ListSQL selects the newest event at or below a revision of every object of
+// a resource, ordered by create revision and starting after a create revision.
+// The delete events of deleted objects are selected as well, so that a limited
+// list can tell where it stopped; ListLimitSQL is ListSQL limited to a number
+// of objects.
+var (
+	ListSQL      = listSQL("")
+	ListLimitSQL = listSQL(`
+		LIMIT ?`)
 )
+
+func listSQL(limit string) string {
+	return fmt.Sprintf(`
+	SELECT (%s), %s
+	FROM watchrelay AS log
+	INNER JOIN (
+		SELECT MAX(mlog.revision) AS revision
+		FROM watchrelay AS mlog
+		WHERE
+			mlog.resource_name = ? AND
+			mlog.revision <= ? AND
+			mlog.create_revision > ?
+		GROUP BY mlog.create_revision
+		ORDER BY mlog.create_revision ASC%s
+	) AS maxlog ON maxlog.revision = log.revision
+	ORDER BY log.create_revision ASC`, RevisionSQL, Columns, limit)
+}
+
+// AfterSQL returns the query of the events of a resource after a revision.
+// The values of the previous events are read if prev is set.
+func AfterSQL(prev bool) string {
+	return fmt.Sprintf(`
+	SELECT (%s), %s
+	FROM watchrelay AS log %s
+	WHERE
+		log.resource_name = ? AND
+		log.revision > ?
+	ORDER BY log.revision ASC`, RevisionSQL, afterColumns(prev), afterJoin(prev))
+}
+
+// AfterAllSQL returns the query of the events of all resources after a
+// revision, as AfterSQL.
+func AfterAllSQL(prev bool) string {
+	return fmt.Sprintf(`
+	SELECT (%s), %s
+	FROM watchrelay AS log %s
+	WHERE
+		log.revision > ?
+	ORDER BY log.revision ASC`, RevisionSQL, afterColumns(prev), afterJoin(prev))
+}
+
+func afterColumns(prev bool) string {
+	if prev {
+		return PrevColumns
+	}
+	return Columns
+}
+
+func afterJoin(prev bool) string {
+	if prev {
+		return PrevJoin
+	}
+	return ""
+}
+
+func columns(prevValue string) string {
+	return fmt.Sprintf(`
+	log.revision, log.create_revision, log.resource_name, log.created, log.deleted, log.value, log.created_at,
+	COALESCE(log.prev_revision, 0), %s, log.trace_context, log.annotations`, prevValue)
+}
+
+var tableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidTableName reports whether name can be used as a table name unquoted.
+func ValidTableName(name string) bool {
+	return tableNameRegexp.MatchString(name)
+}
+
+// Table returns query, written for the watchrelay table, for the event log
+// stored in table. The tables and indexes named after the watchrelay table
+// are renamed along with it.
+func Table(query, table string) string {
+	if table == "" || table == sqllog.DefaultTableName {
+		return query
+	}
+	return strings.ReplaceAll(query, sqllog.DefaultTableName, table)
+}
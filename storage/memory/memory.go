@@ -0,0 +1,335 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hunknownz/watchrelay/event"
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/sqllog"
+)
+
+// MemoryDialect keeps the event log in process. It is meant for tests and
+// ephemeral relays that do not need to survive a restart.
+type MemoryDialect struct {
+	cfg sqllog.Config
+
+	mu         sync.RWMutex
+	events     []*event.LogEvent // sorted by revision
+	objects    map[uint64]*event.LogEvent
+	compactRev uint64
+}
+
+func (d *MemoryDialect) After(ctx context.Context, resourceName string, revision uint64, limit int64) (sqllog.Rows, error) {
+	return d.after(resourceName, revision, limit, false)
+}
+
+func (d *MemoryDialect) AfterWithPrev(ctx context.Context, resourceName string, revision uint64, limit int64) (sqllog.Rows, error) {
+	return d.after(resourceName, revision, limit, true)
+}
+
+func (d *MemoryDialect) after(resourceName string, revision uint64, limit int64, prev bool) (sqllog.Rows, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows := &memoryRows{rev: d.currentRevision()}
+	for _, e := range d.events[d.search(revision+1):] {
+		if resourceName != "" && e.ResourceName != resourceName {
+			continue
+		}
+		if limit > 0 && int64(len(rows.events)) >= limit {
+			break
+		}
+
+		var prevValue []byte
+		if prev {
+			prevValue = d.value(e.PrevRevision)
+		}
+		rows.events = append(rows.events, e)
+		rows.prevValues = append(rows.prevValues, prevValue)
+	}
+	return rows, nil
+}
+
+func (d *MemoryDialect) CurrentRevision(ctx context.Context) (uint64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.currentRevision(), nil
+}
+
+// ClearExpiredEvents compacts the log up to the newest revision older than
+// dur. For every object, identified by its create revision, the newest event
+// at or below the compact revision is kept along with all later events, unless
+// it is the delete event of the object. The newest revision is never compacted.
+func (d *MemoryDialect) ClearExpiredEvents(ctx context.Context, dur time.Duration) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	current := d.currentRevision()
+	if current == 0 {
+		return 0, nil
+	}
+
+	var target uint64
+	expiry := d.cfg.Clock.Now().Add(-dur)
+	for _, e := range d.events {
+		if e.CreatedAt.Before(expiry) && e.Revision > target {
+			target = e.Revision
+		}
+	}
+	if target >= current {
+		target = current - 1
+	}
+	if target <= d.compactRev {
+		return 0, nil
+	}
+
+	newest := make(map[uint64]uint64)
+	for _, e := range d.events[:d.search(target+1)] {
+		newest[e.CreateRevision] = e.Revision
+	}
+
+	kept := make([]*event.LogEvent, 0, len(d.events))
+	for _, e := range d.events {
+		// Events without a create revision cannot be told apart by object.
+		if e.Revision <= target && (isGap(e) || e.CreateRevision > 0 && newest[e.CreateRevision] != e.Revision) {
+			continue
+		}
+		if e.Revision <= target && e.CreateRevision > 0 && e.Deleted {
+			delete(d.objects, e.CreateRevision)
+			continue
+		}
+		kept = append(kept, e)
+	}
+	n := len(d.events) - len(kept)
+	d.events = kept
+	d.compactRev = target
+	return n, nil
+}
+
+func (d *MemoryDialect) CompactRevision(ctx context.Context) (uint64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.compactRev, nil
+}
+
+func (d *MemoryDialect) FillGap(ctx context.Context, revision uint64, resourceName string) error {
+	err := d.Append(ctx, &event.LogEvent{
+		Revision:       revision,
+		CreateRevision: revision,
+		ResourceName:   resourceName,
+		Created:        true,
+		Deleted:        true,
+		CreatedAt:      d.cfg.Clock.Now(),
+	})
+	if err == errDuplicateRevision {
+		d.cfg.Logger.Debug("watchrelay: gap already filled", logging.KeyResource, resourceName, logging.KeyRevision, revision)
+		return nil
+	}
+	return err
+}
+
+// Append adds events to the log. Like a primary key, a revision can only be
+// stored once. Events changing an existing object must follow its newest
+// event, standing in for the compare-and-swap on the resource table. No event
+// is added if any of them is rejected.
+func (d *MemoryDialect) Append(ctx context.Context, events ...*event.LogEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	seen := make(map[uint64]struct{}, len(events))
+	objects := make(map[uint64]*event.LogEvent, len(events))
+	for _, e := range events {
+		if _, ok := seen[e.Revision]; ok || d.contains(e.Revision) {
+			return errDuplicateRevision
+		}
+		seen[e.Revision] = struct{}{}
+
+		if isGap(e) {
+			continue
+		}
+		if e.Created {
+			objects[e.CreateRevision] = e
+			continue
+		}
+		latest, ok := objects[e.CreateRevision]
+		if !ok {
+			latest, ok = d.objects[e.CreateRevision]
+		}
+		if !ok || latest.Deleted {
+			return sqllog.ErrNotFound
+		}
+		if latest.Revision != e.PrevRevision {
+			return &sqllog.ConflictError{Revision: e.PrevRevision, CurrentRevision: latest.Revision}
+		}
+		objects[e.CreateRevision] = e
+	}
+
+	for createRev, e := range objects {
+		d.objects[createRev] = e
+	}
+	for _, e := range events {
+		i := d.search(e.Revision)
+		d.events = append(d.events, nil)
+		copy(d.events[i+1:], d.events[i:])
+		d.events[i] = e
+	}
+	return nil
+}
+
+func (d *MemoryDialect) Get(ctx context.Context, revisions ...uint64) ([]*event.LogEvent, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	events := make([]*event.LogEvent, 0, len(revisions))
+	for _, rev := range revisions {
+		i := d.search(rev)
+		if i < len(d.events) && d.events[i].Revision == rev {
+			events = append(events, d.events[i])
+		}
+	}
+	return events, nil
+}
+
+func (d *MemoryDialect) List(ctx context.Context, resourceName string, revision, after uint64, limit int64) (sqllog.Rows, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	newest := make(map[uint64]*event.LogEvent)
+	for _, e := range d.events[:d.search(revision+1)] {
+		if e.ResourceName == resourceName && !isGap(e) && e.CreateRevision > after {
+			newest[e.CreateRevision] = e
+		}
+	}
+
+	events := make([]*event.LogEvent, 0, len(newest))
+	for _, e := range newest {
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].CreateRevision < events[j].CreateRevision
+	})
+	if limit > 0 && int64(len(events)) > limit {
+		events = events[:limit]
+	}
+
+	// Like the SQL dialects, List leaves out the previous values.
+	return &memoryRows{rev: d.currentRevision(), events: events, prevValues: make([][]byte, len(events))}, nil
+}
+
+// search returns the index of the first event with a revision not less than revision.
+func (d *MemoryDialect) search(revision uint64) int {
+	return sort.Search(len(d.events), func(i int) bool {
+		return d.events[i].Revision >= revision
+	})
+}
+
+// value returns the value of the event at revision, nil if there is none.
+func (d *MemoryDialect) value(revision uint64) []byte {
+	if i := d.search(revision); revision > 0 && i < len(d.events) && d.events[i].Revision == revision {
+		return d.events[i].Value
+	}
+	return nil
+}
+
+func (d *MemoryDialect) contains(revision uint64) bool {
+	i := d.search(revision)
+	return i < len(d.events) && d.events[i].Revision == revision
+}
+
+func isGap(e *event.LogEvent) bool {
+	return e.Created && e.Deleted
+}
+
+func (d *MemoryDialect) currentRevision() uint64 {
+	if len(d.events) == 0 {
+		return 0
+	}
+	return d.events[len(d.events)-1].Revision
+}
+
+var errDuplicateRevision = errors.New("watchrelay: duplicate revision")
+
+// memoryRows yields events in the column order of the SQL dialects:
+// the current revision followed by generic.Columns.
+type memoryRows struct {
+	rev        uint64
+	events     []*event.LogEvent
+	prevValues [][]byte
+	cur        *event.LogEvent
+	curPrev    []byte
+}
+
+func (r *memoryRows) Next() bool {
+	if len(r.events) == 0 {
+		r.cur, r.curPrev = nil, nil
+		return false
+	}
+	r.cur, r.events = r.events[0], r.events[1:]
+	r.curPrev, r.prevValues = r.prevValues[0], r.prevValues[1:]
+	return true
+}
+
+func (r *memoryRows) Scan(dest ...any) error {
+	if r.cur == nil {
+		return fmt.Errorf("watchrelay: Scan called without calling Next")
+	}
+
+	values := []any{r.rev, r.cur.Revision, r.cur.CreateRevision, r.cur.ResourceName, r.cur.Created, r.cur.Deleted, []byte(r.cur.Value), r.cur.CreatedAt,
+		r.cur.PrevRevision, r.curPrev, []byte(r.cur.TraceContext), []byte(r.cur.Annotations)}
+	if len(dest) != len(values) {
+		return fmt.Errorf("watchrelay: expected %d destination arguments in Scan, not %d", len(values), len(dest))
+	}
+	for i, v := range values {
+		if err := assign(dest[i], v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *memoryRows) Err() error {
+	return nil
+}
+
+func (r *memoryRows) Close() error {
+	r.events, r.prevValues = nil, nil
+	r.cur, r.curPrev = nil, nil
+	return nil
+}
+
+func assign(dest, src any) error {
+	if b, ok := src.([]byte); ok {
+		src = append([]byte(nil), b...)
+	}
+
+	dv := reflect.ValueOf(dest)
+	sv := reflect.ValueOf(src)
+	if dv.Kind() != reflect.Pointer || dv.IsNil() || !sv.Type().AssignableTo(dv.Elem().Type()) {
+		return fmt.Errorf("watchrelay: unsupported Scan, storing %T into %T", src, dest)
+	}
+	dv.Elem().Set(sv)
+	return nil
+}
+
+func New() *MemoryDialect {
+	return NewWithConfig(sqllog.Config{})
+}
+
+// NewWithConfig returns a MemoryDialect telling time with the clock and
+// logging with the logger of cfg. The other settings do not apply to it.
+func NewWithConfig(cfg sqllog.Config) *MemoryDialect {
+	return &MemoryDialect{
+		cfg:     cfg.WithDefaults(),
+		objects: make(map[uint64]*event.LogEvent),
+	}
+}
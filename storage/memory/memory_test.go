@@ -0,0 +1,63 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hunknownz/watchrelay/event"
+)
+
+// logEvent returns an event of the object created at createRev, following
+// its event at prevRev, an hour ago.
+func logEvent(rev, createRev, prevRev uint64, created, deleted bool) *event.LogEvent {
+	return &event.LogEvent{
+		Revision:       rev,
+		CreateRevision: createRev,
+		PrevRevision:   prevRev,
+		ResourceName:   "task",
+		Created:        created,
+		Deleted:        deleted,
+		CreatedAt:      time.Now().Add(-time.Hour),
+	}
+}
+
+func TestClearExpiredEvents(t *testing.T) {
+	d := New()
+	ctx := context.Background()
+
+	err := d.Append(ctx,
+		logEvent(1, 1, 0, true, false),
+		logEvent(2, 2, 0, true, false),
+		logEvent(3, 1, 1, false, true),
+		logEvent(4, 4, 0, true, true),
+		logEvent(5, 2, 2, false, false),
+		logEvent(6, 6, 0, true, false),
+	)
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	// Compacting up to revision 5 drops the history and the delete event of
+	// the first object, the gap and the create event of the second object.
+	n, err := d.ClearExpiredEvents(ctx, 0)
+	if err != nil {
+		t.Fatalf("ClearExpiredEvents: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("deleted %d events, want 4", n)
+	}
+	var revs []uint64
+	for _, e := range d.events {
+		revs = append(revs, e.Revision)
+	}
+	if len(revs) != 2 || revs[0] != 5 || revs[1] != 6 {
+		t.Errorf("kept revisions %v, want [5 6]", revs)
+	}
+	if rev, err := d.CompactRevision(ctx); err != nil || rev != 5 {
+		t.Errorf("CompactRevision returned %d, %v, want 5", rev, err)
+	}
+	if _, ok := d.objects[1]; ok {
+		t.Error("the compacted deleted object is still tracked")
+	}
+}
@@ -5,11 +5,11 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/sqllog"
 	"github.com/hunknownz/watchrelay/storage/generic"
-	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -24,28 +24,79 @@ var (
 				deleted BOOLEAN,
 				value MEDIUMBLOB,
 				created_at datetime(3) DEFAULT NULL,
+				trace_context TEXT,
+				annotations JSON,
 				PRIMARY KEY (revision)
 			);`,
 		`CREATE INDEX watchrelay_resource_name_index ON watchrelay (resource_name)`,
 		`CREATE INDEX watchrelay_resource_name_revision_index ON watchrelay (resource_name,revision)`,
 		`CREATE INDEX watchrelay_revision_deleted_index ON watchrelay (revision,deleted)`,
 	}
+	// compactionSchema is applied to existing databases as well, since it
+	// was introduced after the watchrelay table.
+	compactionSchema = []string{
+		`CREATE TABLE IF NOT EXISTS watchrelay_compaction
+			(
+				id int NOT NULL,
+				revision bigint(20) unsigned NOT NULL,
+				PRIMARY KEY (id)
+			);`,
+		`INSERT IGNORE INTO watchrelay_compaction (id, revision) VALUES (1, 0)`,
+	}
+	// indexes are applied to existing tables as well, since they were
+	// introduced after the watchrelay table.
+	indexes = []string{
+		`CREATE INDEX watchrelay_create_revision_revision_index ON watchrelay (create_revision,revision)`,
+		`CREATE INDEX watchrelay_resource_name_create_revision_index ON watchrelay (resource_name,create_revision,revision)`,
+	}
+	// columns adds the columns introduced after the watchrelay table to
+	// existing tables.
+	columns = []string{
+		`ALTER TABLE watchrelay ADD COLUMN trace_context TEXT`,
+		`ALTER TABLE watchrelay ADD COLUMN annotations JSON`,
+	}
+	// DeleteSupersededSQL deletes the events at or below a revision that are
+	// followed by a newer event of the same object at or below the revision.
+	// Events without a create revision, logged by older versions, cannot be
+	// told apart by object and are kept.
+	DeleteSupersededSQL = `
+	DELETE log FROM watchrelay AS log
+	INNER JOIN watchrelay AS newer
+		ON newer.create_revision = log.create_revision AND newer.revision > log.revision
+	WHERE log.revision <= ? AND newer.revision <= ? AND log.create_revision > 0`
 )
 
 type MysqlDialect struct {
-	db *sql.DB
+	generic.Compactor
+
+	db  *sql.DB
+	cfg sqllog.Config
+
+	AfterSQL        string
+	AfterAllSQL     string
+	AfterPrevSQL    string
+	AfterAllPrevSQL string
+	ListSQL         string
+	ListLimitSQL    string
+	RevSQL          string
+	FillGapSQL      string
+}
+
+func (d *MysqlDialect) After(ctx context.Context, resourceName string, revision uint64, limit int64) (sqllog.Rows, error) {
+	return d.after(ctx, d.AfterSQL, d.AfterAllSQL, resourceName, revision, limit)
+}
 
-	AfterSQL    string
-	AfterAllSQL string
-	RevSQL      string
+// AfterWithPrev is After reading the values of the previous events as well.
+func (d *MysqlDialect) AfterWithPrev(ctx context.Context, resourceName string, revision uint64, limit int64) (sqllog.Rows, error) {
+	return d.after(ctx, d.AfterPrevSQL, d.AfterAllPrevSQL, resourceName, revision, limit)
 }
 
-func (d *MysqlDialect) After(ctx context.Context, resourceName string, revision uint64, limit int64) (*sql.Rows, error) {
+func (d *MysqlDialect) after(ctx context.Context, afterSQL, afterAllSQL, resourceName string, revision uint64, limit int64) (sqllog.Rows, error) {
 	var query string
 	if resourceName == "" {
-		query = d.AfterAllSQL
+		query = afterAllSQL
 	} else {
-		query = d.AfterSQL
+		query = afterSQL
 	}
 	if limit > 0 {
 		query = fmt.Sprintf("%s LIMIT %d", query, limit)
@@ -56,6 +107,13 @@ func (d *MysqlDialect) After(ctx context.Context, resourceName string, revision
 	return d.db.QueryContext(ctx, query, resourceName, revision)
 }
 
+func (d *MysqlDialect) List(ctx context.Context, resourceName string, revision, after uint64, limit int64) (sqllog.Rows, error) {
+	if limit > 0 {
+		return d.db.QueryContext(ctx, d.ListLimitSQL, resourceName, revision, after, limit)
+	}
+	return d.db.QueryContext(ctx, d.ListSQL, resourceName, revision, after)
+}
+
 func (d *MysqlDialect) CurrentRevision(ctx context.Context) (uint64, error) {
 	var sqlRev sql.NullInt64
 	err := d.db.QueryRowContext(ctx, d.RevSQL).Scan(&sqlRev)
@@ -71,33 +129,31 @@ func (d *MysqlDialect) CurrentRevision(ctx context.Context) (uint64, error) {
 	return rev, nil
 }
 
-func (d *MysqlDialect) ClearExpiredEvents(ctx context.Context, dur time.Duration) (int, error) {
-	return 0, nil
-}
-
 func (d *MysqlDialect) FillGap(ctx context.Context, revision uint64, resourceName string) error {
-	_, err := d.db.ExecContext(ctx, generic.FillGapSQL, revision, resourceName, revision, time.Now())
+	_, err := d.db.ExecContext(ctx, d.FillGapSQL, revision, resourceName, revision, d.cfg.Clock.Now())
 	var errSql *mysql.MySQLError
 	if errors.As(err, &errSql) {
 		if errSql.Number == 1062 {
 			// Duplicate key error
-			logrus.Debugf("watchrelay: gap %d already filled", revision)
+			d.cfg.Logger.Debug("watchrelay: gap already filled", logging.KeyResource, resourceName, logging.KeyRevision, revision)
 			return nil
 		}
 	}
 	return err
 }
 
-func New(db *sql.DB) (*MysqlDialect, uint64, error) {
+func New(db *sql.DB, cfg sqllog.Config) (*MysqlDialect, uint64, error) {
+	cfg = cfg.WithDefaults()
+
 	var exists bool
-	err := db.QueryRow("SELECT 1 FROM information_schema.TABLES WHERE table_schema = DATABASE() AND table_name = ?", "watchrelay").Scan(&exists)
+	err := db.QueryRow("SELECT 1 FROM information_schema.TABLES WHERE table_schema = DATABASE() AND table_name = ?", cfg.TableName).Scan(&exists)
 	if err != nil && err != sql.ErrNoRows {
-		logrus.Warnf("failed to check if table %s exists: %v", "watchrelay", err)
+		cfg.Logger.Warn("watchrelay: failed to check if table exists", "table", cfg.TableName, logging.KeyError, err)
 	}
 
 	if !exists {
 		for _, stmt := range schema {
-			_, err := db.Exec(stmt)
+			_, err := db.Exec(generic.Table(stmt, cfg.TableName))
 			if err != nil {
 				// If the table already exists, we can ignore the error.
 				if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1061 {
@@ -107,25 +163,31 @@ func New(db *sql.DB) (*MysqlDialect, uint64, error) {
 		}
 	}
 
-	dialect := &MysqlDialect{
-		db: db,
+	for _, stmt := range indexes {
+		if _, err := db.Exec(generic.Table(stmt, cfg.TableName)); err != nil {
+			// If the index already exists, we can ignore the error.
+			if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1061 {
+				return nil, 0, err
+			}
+		}
+	}
+
+	for _, stmt := range compactionSchema {
+		if _, err := db.Exec(generic.Table(stmt, cfg.TableName)); err != nil {
+			return nil, 0, err
+		}
+	}
 
-		AfterSQL: fmt.Sprintf(`
-			SELECT (%s), %s
-			FROM watchrelay AS log
-			WHERE
-			    log.resource_name = ? AND
-				log.revision > ?
-			ORDER BY log.revision ASC`, generic.RevisionSQL, generic.Columns),
-		AfterAllSQL: fmt.Sprintf(`
-			SELECT (%s), %s
-			FROM watchrelay AS log
-			WHERE
-				log.revision > ?
-			ORDER BY log.revision ASC`, generic.RevisionSQL, generic.Columns),
-		RevSQL: generic.RevisionSQL,
+	for _, stmt := range columns {
+		if _, err := db.Exec(generic.Table(stmt, cfg.TableName)); err != nil {
+			// If the column already exists, we can ignore the error.
+			if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1060 {
+				return nil, 0, err
+			}
+		}
 	}
 
+	dialect := NewDialect(db, cfg)
 	rev, err := dialect.CurrentRevision(context.Background())
 	if err != nil {
 		return nil, 0, err
@@ -133,3 +195,37 @@ func New(db *sql.DB) (*MysqlDialect, uint64, error) {
 
 	return dialect, rev, nil
 }
+
+// NewDialect returns a MysqlDialect for db without bootstrapping the schema.
+// It is shared with MySQL compatible databases that create their own tables.
+func NewDialect(db *sql.DB, cfg sqllog.Config) *MysqlDialect {
+	cfg = cfg.WithDefaults()
+	t := func(query string) string {
+		return generic.Table(query, cfg.TableName)
+	}
+
+	return &MysqlDialect{
+		Compactor: generic.Compactor{
+			DB:                  db,
+			Clock:               cfg.Clock,
+			RevSQL:              t(generic.RevisionSQL),
+			ExpiredRevSQL:       t(generic.ExpiredRevisionSQL),
+			CompactRevSQL:       t(generic.CompactRevisionSQL),
+			SetCompactRevSQL:    t(generic.SetCompactRevisionSQL),
+			DeleteSupersededSQL: t(DeleteSupersededSQL),
+			DeleteGapsSQL:       t(generic.DeleteGapsSQL),
+			DeleteTombstonesSQL: t(generic.DeleteTombstonesSQL),
+		},
+		db:  db,
+		cfg: cfg,
+
+		AfterSQL:        t(generic.AfterSQL(false)),
+		AfterAllSQL:     t(generic.AfterAllSQL(false)),
+		AfterPrevSQL:    t(generic.AfterSQL(true)),
+		AfterAllPrevSQL: t(generic.AfterAllSQL(true)),
+		ListSQL:         t(generic.ListSQL),
+		ListLimitSQL:    t(generic.ListLimitSQL),
+		RevSQL:          t(generic.RevisionSQL),
+		FillGapSQL:      t(generic.FillGapSQL),
+	}
+}
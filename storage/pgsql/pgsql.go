@@ -1,7 +1,215 @@
 package pgsql
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 
-func New(db *sql.DB) (err error) {
-	return nil
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/sqllog"
+	"github.com/hunknownz/watchrelay/storage/generic"
+)
+
+const (
+	// uniqueViolation is the SQLSTATE reported for duplicate keys.
+	uniqueViolation = "23505"
+)
+
+var (
+	schema = []string{
+		`CREATE TABLE IF NOT EXISTS watchrelay
+			(
+				revision bigint NOT NULL,
+				create_revision bigint,
+				prev_revision bigint,
+				resource_name VARCHAR(511),
+				created BOOLEAN,
+				deleted BOOLEAN,
+				value text,
+				created_at timestamp(3) DEFAULT NULL,
+				trace_context text,
+				annotations jsonb,
+				PRIMARY KEY (revision)
+			);`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_resource_name_index ON watchrelay (resource_name)`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_resource_name_revision_index ON watchrelay (resource_name,revision)`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_revision_deleted_index ON watchrelay (revision,deleted)`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_create_revision_revision_index ON watchrelay (create_revision,revision)`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_resource_name_create_revision_index ON watchrelay (resource_name,create_revision,revision)`,
+		`CREATE TABLE IF NOT EXISTS watchrelay_compaction
+			(
+				id int NOT NULL,
+				revision bigint NOT NULL,
+				PRIMARY KEY (id)
+			);`,
+		`INSERT INTO watchrelay_compaction (id, revision) VALUES (1, 0) ON CONFLICT DO NOTHING`,
+		// Columns introduced after the watchrelay table.
+		`ALTER TABLE watchrelay ADD COLUMN IF NOT EXISTS trace_context text`,
+		`ALTER TABLE watchrelay ADD COLUMN IF NOT EXISTS annotations jsonb`,
+	}
+	// DeleteSupersededSQL deletes the events at or below a revision that are
+	// followed by a newer event of the same object at or below the revision.
+	// Events without a create revision, logged by older versions, cannot be
+	// told apart by object and are kept.
+	DeleteSupersededSQL = `
+	DELETE FROM watchrelay AS log
+	USING watchrelay AS newer
+	WHERE
+		newer.create_revision = log.create_revision AND
+		newer.revision > log.revision AND
+		log.create_revision > 0 AND
+		log.revision <= ? AND
+		newer.revision <= ?`
+)
+
+// sqlState is implemented by the errors of both lib/pq and pgx.
+type sqlState interface {
+	SQLState() string
+}
+
+type PgsqlDialect struct {
+	generic.Compactor
+
+	db  *sql.DB
+	cfg sqllog.Config
+
+	AfterSQL        string
+	AfterAllSQL     string
+	AfterPrevSQL    string
+	AfterAllPrevSQL string
+	ListSQL         string
+	ListLimitSQL    string
+	RevSQL          string
+	FillGapSQL      string
+}
+
+func (d *PgsqlDialect) After(ctx context.Context, resourceName string, revision uint64, limit int64) (sqllog.Rows, error) {
+	return d.after(ctx, d.AfterSQL, d.AfterAllSQL, resourceName, revision, limit)
+}
+
+// AfterWithPrev is After reading the values of the previous events as well.
+func (d *PgsqlDialect) AfterWithPrev(ctx context.Context, resourceName string, revision uint64, limit int64) (sqllog.Rows, error) {
+	return d.after(ctx, d.AfterPrevSQL, d.AfterAllPrevSQL, resourceName, revision, limit)
+}
+
+func (d *PgsqlDialect) after(ctx context.Context, afterSQL, afterAllSQL, resourceName string, revision uint64, limit int64) (sqllog.Rows, error) {
+	var query string
+	if resourceName == "" {
+		query = afterAllSQL
+	} else {
+		query = afterSQL
+	}
+	if limit > 0 {
+		query = fmt.Sprintf("%s LIMIT %d", query, limit)
+	}
+	if resourceName == "" {
+		return d.db.QueryContext(ctx, query, revision)
+	}
+	return d.db.QueryContext(ctx, query, resourceName, revision)
+}
+
+func (d *PgsqlDialect) List(ctx context.Context, resourceName string, revision, after uint64, limit int64) (sqllog.Rows, error) {
+	if limit > 0 {
+		return d.db.QueryContext(ctx, d.ListLimitSQL, resourceName, revision, after, limit)
+	}
+	return d.db.QueryContext(ctx, d.ListSQL, resourceName, revision, after)
+}
+
+func (d *PgsqlDialect) CurrentRevision(ctx context.Context) (uint64, error) {
+	var sqlRev sql.NullInt64
+	err := d.db.QueryRowContext(ctx, d.RevSQL).Scan(&sqlRev)
+	if err != nil {
+		return 0, err
+	}
+	var rev uint64
+	if sqlRev.Valid {
+		rev = uint64(sqlRev.Int64)
+	} else {
+		rev = 0
+	}
+	return rev, nil
+}
+
+func (d *PgsqlDialect) FillGap(ctx context.Context, revision uint64, resourceName string) error {
+	_, err := d.db.ExecContext(ctx, d.FillGapSQL, revision, resourceName, revision, d.cfg.Clock.Now())
+	var errState sqlState
+	if errors.As(err, &errState) {
+		if errState.SQLState() == uniqueViolation {
+			// Duplicate key error
+			d.cfg.Logger.Debug("watchrelay: gap already filled", logging.KeyResource, resourceName, logging.KeyRevision, revision)
+			return nil
+		}
+	}
+	return err
+}
+
+// q rewrites the ? placeholders of generic SQL into postgres $n placeholders.
+func q(sql string) string {
+	if !strings.Contains(sql, "?") {
+		return sql
+	}
+
+	var (
+		b strings.Builder
+		n int
+	)
+	for _, r := range sql {
+		if r == '?' {
+			n++
+			b.WriteString("$")
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func New(db *sql.DB, cfg sqllog.Config) (*PgsqlDialect, uint64, error) {
+	cfg = cfg.WithDefaults()
+	t := func(query string) string {
+		return q(generic.Table(query, cfg.TableName))
+	}
+
+	for _, stmt := range schema {
+		_, err := db.Exec(generic.Table(stmt, cfg.TableName))
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	dialect := &PgsqlDialect{
+		Compactor: generic.Compactor{
+			DB:                  db,
+			Clock:               cfg.Clock,
+			RevSQL:              t(generic.RevisionSQL),
+			ExpiredRevSQL:       t(generic.ExpiredRevisionSQL),
+			CompactRevSQL:       t(generic.CompactRevisionSQL),
+			SetCompactRevSQL:    t(generic.SetCompactRevisionSQL),
+			DeleteSupersededSQL: t(DeleteSupersededSQL),
+			DeleteGapsSQL:       t(generic.DeleteGapsSQL),
+			DeleteTombstonesSQL: t(generic.DeleteTombstonesSQL),
+		},
+		db:  db,
+		cfg: cfg,
+
+		AfterSQL:        t(generic.AfterSQL(false)),
+		AfterAllSQL:     t(generic.AfterAllSQL(false)),
+		AfterPrevSQL:    t(generic.AfterSQL(true)),
+		AfterAllPrevSQL: t(generic.AfterAllSQL(true)),
+		ListSQL:         t(generic.ListSQL),
+		ListLimitSQL:    t(generic.ListLimitSQL),
+		RevSQL:          t(generic.RevisionSQL),
+		FillGapSQL:      t(generic.FillGapSQL),
+	}
+
+	rev, err := dialect.CurrentRevision(context.Background())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return dialect, rev, nil
 }
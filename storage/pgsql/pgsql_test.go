@@ -0,0 +1,151 @@
+package pgsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hunknownz/watchrelay/internal/fakesql"
+	"github.com/hunknownz/watchrelay/sqllog"
+)
+
+// pgError is a postgres error reporting its SQLSTATE, like those of lib/pq
+// and pgx.
+type pgError struct {
+	state string
+}
+
+func (e *pgError) Error() string    { return "pq: " + e.state }
+func (e *pgError) SQLState() string { return e.state }
+
+// newDialect returns a PgsqlDialect whose FillGap statements fail with
+// fillGapErr, along with the recorder of its statements.
+func newDialect(t *testing.T, fillGapErr error) (*PgsqlDialect, *fakesql.Recorder) {
+	t.Helper()
+
+	db, rec := fakesql.Open(func(query string, args []driver.Value) ([][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "AS current_revision"):
+			return [][]driver.Value{{nil}}, nil
+		case strings.Contains(query, "TRUE, TRUE"):
+			return nil, fillGapErr
+		}
+		return nil, nil
+	})
+	t.Cleanup(func() { db.Close() })
+
+	d, _, err := New(db, sqllog.Config{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return d, rec
+}
+
+func TestQ(t *testing.T) {
+	tests := []struct {
+		sql, want string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"WHERE a = ?", "WHERE a = $1"},
+		{"WHERE a = ? AND b > ? LIMIT ?", "WHERE a = $1 AND b > $2 LIMIT $3"},
+	}
+	for _, tt := range tests {
+		if got := q(tt.sql); got != tt.want {
+			t.Errorf("q(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestAfterPlaceholders(t *testing.T) {
+	d, rec := newDialect(t, nil)
+	ctx := context.Background()
+
+	tests := []struct {
+		resourceName string
+		limit        int64
+		args         int
+	}{
+		{"", 0, 1},
+		{"task", 0, 2},
+		{"task", 10, 2},
+	}
+	for _, tt := range tests {
+		rows, err := d.After(ctx, tt.resourceName, 5, tt.limit)
+		if err != nil {
+			t.Fatalf("After: %v", err)
+		}
+		rows.Close()
+
+		statements := rec.Statements()
+		s := statements[len(statements)-1]
+		if strings.Contains(s.Query, "?") {
+			t.Errorf("After(%q) left ? placeholders in %s", tt.resourceName, s.Query)
+		}
+		if len(s.Args) != tt.args || !strings.Contains(s.Query, "$"+strconv.Itoa(tt.args)) {
+			t.Errorf("After(%q) ran %s with %d args, want placeholders up to $%d", tt.resourceName, s.Query, len(s.Args), tt.args)
+		}
+		if tt.limit > 0 && !strings.Contains(s.Query, "LIMIT 10") {
+			t.Errorf("After with limit %d ran %s, want LIMIT 10", tt.limit, s.Query)
+		}
+	}
+}
+
+func TestListPlaceholders(t *testing.T) {
+	d, rec := newDialect(t, nil)
+	ctx := context.Background()
+
+	tests := []struct {
+		limit int64
+		args  int
+	}{
+		{0, 3},
+		{10, 4},
+	}
+	for _, tt := range tests {
+		rows, err := d.List(ctx, "task", 5, 2, tt.limit)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		rows.Close()
+
+		statements := rec.Statements()
+		s := statements[len(statements)-1]
+		if strings.Contains(s.Query, "?") {
+			t.Errorf("List with limit %d left ? placeholders in %s", tt.limit, s.Query)
+		}
+		if len(s.Args) != tt.args || !strings.Contains(s.Query, "$"+strconv.Itoa(tt.args)) {
+			t.Errorf("List with limit %d ran %s with %d args, want placeholders up to $%d", tt.limit, s.Query, len(s.Args), tt.args)
+		}
+		if tt.limit > 0 && !strings.Contains(s.Query, "LIMIT $4") {
+			t.Errorf("List with limit %d ran %s, want LIMIT $4", tt.limit, s.Query)
+		}
+	}
+}
+
+func TestFillGap(t *testing.T) {
+	ctx := context.Background()
+
+	// A revision committed concurrently is a duplicate key.
+	d, rec := newDialect(t, &pgError{state: uniqueViolation})
+	if err := d.FillGap(ctx, 3, ""); err != nil {
+		t.Errorf("FillGap of a filled revision returned %v", err)
+	}
+	statements := rec.Statements()
+	if s := statements[len(statements)-1]; !strings.Contains(s.Query, "$4") || len(s.Args) != 4 {
+		t.Errorf("FillGap ran %s with %d args, want 4 placeholders", s.Query, len(s.Args))
+	}
+
+	// Any other error is returned.
+	d, _ = newDialect(t, &pgError{state: "40001"})
+	if err := d.FillGap(ctx, 3, ""); err == nil {
+		t.Error("FillGap returned no error for a serialization failure")
+	}
+	errBroken := errors.New("broken pipe")
+	d, _ = newDialect(t, errBroken)
+	if err := d.FillGap(ctx, 3, ""); !errors.Is(err, errBroken) {
+		t.Errorf("FillGap returned %v, want %v", err, errBroken)
+	}
+}
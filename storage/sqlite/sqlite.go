@@ -1,7 +1,221 @@
 package sqlite
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 
-func New(db *sql.DB) (err error) {
-	return nil
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/sqllog"
+	"github.com/hunknownz/watchrelay/storage/generic"
+)
+
+const (
+	// Extended result codes for SQLITE_CONSTRAINT_PRIMARYKEY and
+	// SQLITE_CONSTRAINT_UNIQUE.
+	constraintPrimaryKey = 1555
+	constraintUnique     = 2067
+)
+
+var (
+	schema = []string{
+		`CREATE TABLE IF NOT EXISTS watchrelay
+			(
+				revision INTEGER NOT NULL,
+				create_revision INTEGER,
+				prev_revision INTEGER,
+				resource_name TEXT,
+				created BOOLEAN,
+				deleted BOOLEAN,
+				value BLOB,
+				created_at DATETIME DEFAULT NULL,
+				trace_context TEXT,
+				annotations TEXT,
+				PRIMARY KEY (revision)
+			);`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_resource_name_index ON watchrelay (resource_name)`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_resource_name_revision_index ON watchrelay (resource_name,revision)`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_revision_deleted_index ON watchrelay (revision,deleted)`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_create_revision_revision_index ON watchrelay (create_revision,revision)`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_resource_name_create_revision_index ON watchrelay (resource_name,create_revision,revision)`,
+		`CREATE TABLE IF NOT EXISTS watchrelay_compaction
+			(
+				id INTEGER NOT NULL,
+				revision INTEGER NOT NULL,
+				PRIMARY KEY (id)
+			);`,
+		`INSERT INTO watchrelay_compaction (id, revision) VALUES (1, 0) ON CONFLICT DO NOTHING`,
+	}
+	// columns adds the columns introduced after the watchrelay table to
+	// existing tables.
+	columns = []string{
+		`ALTER TABLE watchrelay ADD COLUMN trace_context TEXT`,
+		`ALTER TABLE watchrelay ADD COLUMN annotations TEXT`,
+	}
+	// DeleteSupersededSQL deletes the events at or below a revision that are
+	// followed by a newer event of the same object at or below the revision.
+	// Events without a create revision, logged by older versions, cannot be
+	// told apart by object and are kept.
+	DeleteSupersededSQL = `
+	DELETE FROM watchrelay
+	WHERE
+		revision <= ? AND
+		create_revision > 0 AND
+		EXISTS (
+			SELECT 1
+			FROM watchrelay AS newer
+			WHERE
+				newer.create_revision = watchrelay.create_revision AND
+				newer.revision > watchrelay.revision AND
+				newer.revision <= ?
+		)`
+)
+
+// errorCode is implemented by the errors of modernc.org/sqlite, which
+// report the extended result code.
+type errorCode interface {
+	Code() int
+}
+
+type SqliteDialect struct {
+	generic.Compactor
+
+	db  *sql.DB
+	cfg sqllog.Config
+
+	AfterSQL        string
+	AfterAllSQL     string
+	AfterPrevSQL    string
+	AfterAllPrevSQL string
+	ListSQL         string
+	ListLimitSQL    string
+	RevSQL          string
+	FillGapSQL      string
+}
+
+func (d *SqliteDialect) After(ctx context.Context, resourceName string, revision uint64, limit int64) (sqllog.Rows, error) {
+	return d.after(ctx, d.AfterSQL, d.AfterAllSQL, resourceName, revision, limit)
+}
+
+// AfterWithPrev is After reading the values of the previous events as well.
+func (d *SqliteDialect) AfterWithPrev(ctx context.Context, resourceName string, revision uint64, limit int64) (sqllog.Rows, error) {
+	return d.after(ctx, d.AfterPrevSQL, d.AfterAllPrevSQL, resourceName, revision, limit)
+}
+
+func (d *SqliteDialect) after(ctx context.Context, afterSQL, afterAllSQL, resourceName string, revision uint64, limit int64) (sqllog.Rows, error) {
+	var query string
+	if resourceName == "" {
+		query = afterAllSQL
+	} else {
+		query = afterSQL
+	}
+	if limit > 0 {
+		query = fmt.Sprintf("%s LIMIT %d", query, limit)
+	}
+	if resourceName == "" {
+		return d.db.QueryContext(ctx, query, revision)
+	}
+	return d.db.QueryContext(ctx, query, resourceName, revision)
+}
+
+func (d *SqliteDialect) List(ctx context.Context, resourceName string, revision, after uint64, limit int64) (sqllog.Rows, error) {
+	if limit > 0 {
+		return d.db.QueryContext(ctx, d.ListLimitSQL, resourceName, revision, after, limit)
+	}
+	return d.db.QueryContext(ctx, d.ListSQL, resourceName, revision, after)
+}
+
+func (d *SqliteDialect) CurrentRevision(ctx context.Context) (uint64, error) {
+	var sqlRev sql.NullInt64
+	err := d.db.QueryRowContext(ctx, d.RevSQL).Scan(&sqlRev)
+	if err != nil {
+		return 0, err
+	}
+	var rev uint64
+	if sqlRev.Valid {
+		rev = uint64(sqlRev.Int64)
+	} else {
+		rev = 0
+	}
+	return rev, nil
+}
+
+func (d *SqliteDialect) FillGap(ctx context.Context, revision uint64, resourceName string) error {
+	_, err := d.db.ExecContext(ctx, d.FillGapSQL, revision, resourceName, revision, d.cfg.Clock.Now())
+	if isConstraintError(err) {
+		// Duplicate key error
+		d.cfg.Logger.Debug("watchrelay: gap already filled", logging.KeyResource, resourceName, logging.KeyRevision, revision)
+		return nil
+	}
+	return err
+}
+
+// isConstraintError reports whether err is a primary key or unique constraint
+// violation. mattn/go-sqlite3 does not expose its codes through an interface,
+// so its errors are matched by message.
+func isConstraintError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var errCode errorCode
+	if errors.As(err, &errCode) {
+		code := errCode.Code()
+		return code == constraintPrimaryKey || code == constraintUnique
+	}
+	return strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+func New(db *sql.DB, cfg sqllog.Config) (*SqliteDialect, uint64, error) {
+	cfg = cfg.WithDefaults()
+	t := func(query string) string {
+		return generic.Table(query, cfg.TableName)
+	}
+
+	for _, stmt := range schema {
+		_, err := db.Exec(generic.Table(stmt, cfg.TableName))
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	for _, stmt := range columns {
+		_, err := db.Exec(generic.Table(stmt, cfg.TableName))
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return nil, 0, err
+		}
+	}
+
+	dialect := &SqliteDialect{
+		Compactor: generic.Compactor{
+			DB:                  db,
+			Clock:               cfg.Clock,
+			RevSQL:              t(generic.RevisionSQL),
+			ExpiredRevSQL:       t(generic.ExpiredRevisionSQL),
+			CompactRevSQL:       t(generic.CompactRevisionSQL),
+			SetCompactRevSQL:    t(generic.SetCompactRevisionSQL),
+			DeleteSupersededSQL: t(DeleteSupersededSQL),
+			DeleteGapsSQL:       t(generic.DeleteGapsSQL),
+			DeleteTombstonesSQL: t(generic.DeleteTombstonesSQL),
+		},
+		db:  db,
+		cfg: cfg,
+
+		AfterSQL:        t(generic.AfterSQL(false)),
+		AfterAllSQL:     t(generic.AfterAllSQL(false)),
+		AfterPrevSQL:    t(generic.AfterSQL(true)),
+		AfterAllPrevSQL: t(generic.AfterAllSQL(true)),
+		ListSQL:         t(generic.ListSQL),
+		ListLimitSQL:    t(generic.ListLimitSQL),
+		RevSQL:          t(generic.RevisionSQL),
+		FillGapSQL:      t(generic.FillGapSQL),
+	}
+
+	rev, err := dialect.CurrentRevision(context.Background())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return dialect, rev, nil
 }
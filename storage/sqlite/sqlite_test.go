@@ -0,0 +1,154 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hunknownz/watchrelay/sqllog"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newDialect returns a SqliteDialect on a new database file.
+func newDialect(t *testing.T) (*SqliteDialect, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "watchrelay.db"))
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	d, _, err := New(db, sqllog.Config{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return d, db
+}
+
+// insert logs an event of the object created at createRev, an hour ago.
+func insert(t *testing.T, db *sql.DB, rev, createRev uint64, created, deleted bool) {
+	t.Helper()
+
+	_, err := db.Exec(`INSERT INTO watchrelay(revision, create_revision, prev_revision, resource_name, created, deleted, value, created_at)
+		VALUES(?, ?, 0, 'task', ?, ?, '', ?)`, rev, createRev, created, deleted, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("insert revision %d: %v", rev, err)
+	}
+}
+
+// logged returns the revisions in the log.
+func logged(t *testing.T, db *sql.DB) []uint64 {
+	t.Helper()
+
+	rows, err := db.Query(`SELECT revision FROM watchrelay ORDER BY revision`)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	defer rows.Close()
+
+	var revs []uint64
+	for rows.Next() {
+		var rev uint64
+		if err := rows.Scan(&rev); err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		revs = append(revs, rev)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	return revs
+}
+
+func TestClearExpiredEvents(t *testing.T) {
+	d, db := newDialect(t)
+	ctx := context.Background()
+
+	insert(t, db, 1, 1, true, false)
+	insert(t, db, 2, 2, true, false)
+	insert(t, db, 3, 1, false, true)
+	insert(t, db, 4, 4, true, true)
+	insert(t, db, 5, 2, false, false)
+	insert(t, db, 6, 6, true, false)
+
+	// Compacting up to revision 5 drops the history and the delete event of
+	// the first object, the gap and the create event of the second object.
+	n, err := d.ClearExpiredEvents(ctx, 0)
+	if err != nil {
+		t.Fatalf("ClearExpiredEvents: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("deleted %d events, want 4", n)
+	}
+	revs := logged(t, db)
+	if len(revs) != 2 || revs[0] != 5 || revs[1] != 6 {
+		t.Errorf("kept revisions %v, want [5 6]", revs)
+	}
+	if rev, err := d.CompactRevision(ctx); err != nil || rev != 5 {
+		t.Errorf("CompactRevision returned %d, %v, want 5", rev, err)
+	}
+}
+
+// codeError is an error reporting its extended result code, like those of
+// modernc.org/sqlite.
+type codeError struct {
+	code int
+}
+
+func (e *codeError) Error() string { return fmt.Sprintf("sqlite error %d", e.code) }
+func (e *codeError) Code() int     { return e.code }
+
+func TestIsConstraintError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&codeError{constraintPrimaryKey}, true},
+		{&codeError{constraintUnique}, true},
+		{fmt.Errorf("insert: %w", &codeError{constraintPrimaryKey}), true},
+		// SQLITE_CONSTRAINT_NOTNULL
+		{&codeError{1299}, false},
+		// mattn/go-sqlite3 is matched by message.
+		{errors.New("UNIQUE constraint failed: watchrelay.revision"), true},
+		{errors.New("database is locked"), false},
+	}
+	for _, tt := range tests {
+		if got := isConstraintError(tt.err); got != tt.want {
+			t.Errorf("isConstraintError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFillGap(t *testing.T) {
+	d, db := newDialect(t)
+	ctx := context.Background()
+
+	insert(t, db, 2, 2, true, false)
+
+	// Filling a committed revision, or a gap twice, leaves the log as it is.
+	for _, rev := range []uint64{1, 1, 2} {
+		if err := d.FillGap(ctx, rev, ""); err != nil {
+			t.Fatalf("FillGap(%d): %v", rev, err)
+		}
+	}
+	revs := logged(t, db)
+	if len(revs) != 2 || revs[0] != 1 || revs[1] != 2 {
+		t.Errorf("logged revisions %v, want [1 2]", revs)
+	}
+
+	var gaps int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM watchrelay WHERE created = TRUE AND deleted = TRUE`).Scan(&gaps); err != nil {
+		t.Fatalf("QueryRow: %v", err)
+	}
+	if gaps != 1 {
+		t.Errorf("logged %d gaps, want 1", gaps)
+	}
+}
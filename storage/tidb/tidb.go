@@ -1,7 +1,142 @@
-package sqlite
+package tidb
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
 
-func New(db *sql.DB) (err error) {
-	return nil
+	"github.com/go-sql-driver/mysql"
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/sqllog"
+	"github.com/hunknownz/watchrelay/storage/generic"
+	mysqldialect "github.com/hunknownz/watchrelay/storage/mysql"
+)
+
+const (
+	errDupEntry       = 1062
+	errNoSuchFunction = 1305
+	errTxnRetryable   = 8022
+	errWriteConflict  = 9007
+
+	fillGapRetries = 5
+	fillGapBackoff = 50 * time.Millisecond
+)
+
+var (
+	// Revisions are allocated monotonically, so using them as the clustered
+	// primary key would funnel every insert into a single region. The rows are
+	// clustered on an AUTO_RANDOM id instead, and the uniqueness of revisions is
+	// enforced by a unique index.
+	schema = []string{
+		`CREATE TABLE IF NOT EXISTS watchrelay
+			(
+				id bigint NOT NULL AUTO_RANDOM,
+				revision bigint(20) unsigned NOT NULL,
+				create_revision bigint(20) unsigned,
+				prev_revision bigint(20) unsigned,
+				resource_name VARCHAR(511) CHARACTER SET ascii,
+				created BOOLEAN,
+				deleted BOOLEAN,
+				value MEDIUMBLOB,
+				created_at datetime(3) DEFAULT NULL,
+				trace_context TEXT,
+				annotations JSON,
+				PRIMARY KEY (id) CLUSTERED,
+				UNIQUE KEY watchrelay_revision_index (revision)
+			);`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_resource_name_index ON watchrelay (resource_name)`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_resource_name_revision_index ON watchrelay (resource_name,revision)`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_revision_deleted_index ON watchrelay (revision,deleted)`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_create_revision_revision_index ON watchrelay (create_revision,revision)`,
+		`CREATE INDEX IF NOT EXISTS watchrelay_resource_name_create_revision_index ON watchrelay (resource_name,create_revision,revision)`,
+		`CREATE TABLE IF NOT EXISTS watchrelay_compaction
+			(
+				id int NOT NULL,
+				revision bigint(20) unsigned NOT NULL,
+				PRIMARY KEY (id)
+			);`,
+		`INSERT IGNORE INTO watchrelay_compaction (id, revision) VALUES (1, 0)`,
+		// Columns introduced after the watchrelay table.
+		`ALTER TABLE watchrelay ADD COLUMN IF NOT EXISTS trace_context TEXT`,
+		`ALTER TABLE watchrelay ADD COLUMN IF NOT EXISTS annotations JSON`,
+	}
+)
+
+// TidbDialect shares its queries with MysqlDialect. Revisions are still
+// assigned by the relay; TiDB only differs in how the table is laid out and
+// in how optimistic transactions report conflicting writes.
+type TidbDialect struct {
+	*mysqldialect.MysqlDialect
+
+	db  *sql.DB
+	cfg sqllog.Config
+}
+
+// FillGap inserts a gap marker for revision. Under optimistic transactions a
+// writer committing the same revision concurrently surfaces as a write
+// conflict rather than a duplicate key, so the insert is retried until one of
+// the two outcomes is settled.
+func (d *TidbDialect) FillGap(ctx context.Context, revision uint64, resourceName string) error {
+	var err error
+	for i := 0; i < fillGapRetries; i++ {
+		_, err = d.db.ExecContext(ctx, d.FillGapSQL, revision, resourceName, revision, d.cfg.Clock.Now())
+		var errSql *mysql.MySQLError
+		if !errors.As(err, &errSql) {
+			return err
+		}
+
+		switch errSql.Number {
+		case errDupEntry:
+			// Duplicate key error
+			d.cfg.Logger.Debug("watchrelay: gap already filled", logging.KeyResource, resourceName, logging.KeyRevision, revision)
+			return nil
+		case errWriteConflict, errTxnRetryable:
+			d.cfg.Logger.Debug("watchrelay: write conflict filling gap, retrying", logging.KeyResource, resourceName, logging.KeyRevision, revision, logging.KeyError, err)
+		default:
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(fillGapBackoff * time.Duration(i+1)):
+		}
+	}
+	return err
+}
+
+// IsTiDB reports whether db is a TiDB server. Servers without the
+// tidb_version function are taken for MySQL; any other error is returned.
+func IsTiDB(db *sql.DB) (bool, error) {
+	var version string
+	err := db.QueryRow("SELECT tidb_version()").Scan(&version)
+	var errSql *mysql.MySQLError
+	if errors.As(err, &errSql) && errSql.Number == errNoSuchFunction {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func New(db *sql.DB, cfg sqllog.Config) (*TidbDialect, uint64, error) {
+	cfg = cfg.WithDefaults()
+	for _, stmt := range schema {
+		_, err := db.Exec(generic.Table(stmt, cfg.TableName))
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	dialect := &TidbDialect{
+		MysqlDialect: mysqldialect.NewDialect(db, cfg),
+		db:           db,
+		cfg:          cfg,
+	}
+
+	rev, err := dialect.CurrentRevision(context.Background())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return dialect, rev, nil
 }
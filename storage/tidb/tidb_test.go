@@ -0,0 +1,107 @@
+package tidb
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/hunknownz/watchrelay/internal/fakesql"
+	"github.com/hunknownz/watchrelay/sqllog"
+)
+
+func TestIsTiDB(t *testing.T) {
+	errBroken := errors.New("broken pipe")
+	denied := &mysql.MySQLError{Number: 1142, Message: "command denied"}
+	tests := []struct {
+		name    string
+		rows    [][]driver.Value
+		err     error
+		want    bool
+		wantErr error
+	}{
+		{"tidb", [][]driver.Value{{"Release Version: v7.5.0"}}, nil, true, nil},
+		{"mysql", nil, &mysql.MySQLError{Number: errNoSuchFunction, Message: "FUNCTION test.tidb_version does not exist"}, false, nil},
+		{"denied", nil, denied, false, denied},
+		{"broken", nil, errBroken, false, errBroken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := fakesql.Open(func(string, []driver.Value) ([][]driver.Value, error) {
+				return tt.rows, tt.err
+			})
+			defer db.Close()
+
+			got, err := IsTiDB(db)
+			if got != tt.want {
+				t.Errorf("IsTiDB = %v, want %v", got, tt.want)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("IsTiDB returned %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// newDialect returns a TidbDialect whose FillGap statements fail with the
+// errors of fillGapErrs in turn, then succeed. The number of FillGap
+// statements run is counted in fillGaps.
+func newDialect(t *testing.T, fillGaps *atomic.Int32, fillGapErrs ...error) *TidbDialect {
+	t.Helper()
+
+	db, _ := fakesql.Open(func(query string, args []driver.Value) ([][]driver.Value, error) {
+		switch {
+		case strings.Contains(query, "AS current_revision"):
+			return [][]driver.Value{{nil}}, nil
+		case strings.Contains(query, "TRUE, TRUE"):
+			n := int(fillGaps.Add(1))
+			if n <= len(fillGapErrs) {
+				return nil, fillGapErrs[n-1]
+			}
+		}
+		return nil, nil
+	})
+	t.Cleanup(func() { db.Close() })
+
+	d, _, err := New(db, sqllog.Config{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return d
+}
+
+func TestFillGapRetry(t *testing.T) {
+	ctx := context.Background()
+	conflict := &mysql.MySQLError{Number: errWriteConflict, Message: "Write conflict"}
+	retryable := &mysql.MySQLError{Number: errTxnRetryable, Message: "Transaction is retryable"}
+	dup := &mysql.MySQLError{Number: errDupEntry, Message: "Duplicate entry"}
+
+	tests := []struct {
+		name  string
+		errs  []error
+		runs  int32
+		fails bool
+	}{
+		{"write conflict", []error{conflict, retryable}, 3, false},
+		{"filled concurrently", []error{conflict, dup}, 2, false},
+		{"keeps conflicting", []error{conflict, conflict, conflict, conflict, conflict}, fillGapRetries, true},
+		{"other error", []error{&mysql.MySQLError{Number: 1146, Message: "Table doesn't exist"}}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs atomic.Int32
+			d := newDialect(t, &runs, tt.errs...)
+
+			err := d.FillGap(ctx, 3, "")
+			if (err != nil) != tt.fails {
+				t.Errorf("FillGap returned %v", err)
+			}
+			if got := runs.Load(); got != tt.runs {
+				t.Errorf("FillGap ran %d inserts, want %d", got, tt.runs)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Package tracing defines the tracing hooks of the relay. Its interfaces
+// follow the shape of OpenTelemetry's, so that thin adapters connect them to
+// an OpenTelemetry SDK without the relay depending on it.
+package tracing
+
+import "context"
+
+// Keys of the attributes set on spans.
+const (
+	KeyResource = "watchrelay.resource"
+	KeyRevision = "watchrelay.revision"
+	KeyAction   = "watchrelay.action"
+	KeyEvents   = "watchrelay.events"
+)
+
+// Attribute is a key and value describing a span.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Attr returns an Attribute.
+func Attr(key string, value any) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Span is an operation being traced.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	// RecordError records err as the reason the operation failed.
+	RecordError(err error)
+	End()
+}
+
+// Tracer starts spans.
+type Tracer interface {
+	// Start starts a span, child of the span in ctx if any, and returns a
+	// context holding it.
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Carrier stores a trace context as string pairs, like OpenTelemetry's
+// TextMapCarrier.
+type Carrier interface {
+	Get(key string) string
+	Set(key, value string)
+	Keys() []string
+}
+
+// Propagator writes the trace context of a context to a carrier and reads it
+// back, like OpenTelemetry's TextMapPropagator.
+type Propagator interface {
+	Inject(ctx context.Context, carrier Carrier)
+	Extract(ctx context.Context, carrier Carrier) context.Context
+}
+
+// MapCarrier is a Carrier backed by a map.
+type MapCarrier map[string]string
+
+func (c MapCarrier) Get(key string) string {
+	return c[key]
+}
+
+func (c MapCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c MapCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string, _ ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+// Noop returns a Tracer whose spans record nothing.
+func Noop() Tracer {
+	return noopTracer{}
+}
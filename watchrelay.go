@@ -5,29 +5,130 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/hunknownz/watchrelay/event"
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/publisher"
 	"github.com/hunknownz/watchrelay/resource"
 	"github.com/hunknownz/watchrelay/sqllog"
+	"github.com/hunknownz/watchrelay/storage/generic"
 	"github.com/hunknownz/watchrelay/storage/mysql"
-	"github.com/sirupsen/logrus"
+	"github.com/hunknownz/watchrelay/storage/pgsql"
+	"github.com/hunknownz/watchrelay/storage/sqlite"
+	"github.com/hunknownz/watchrelay/storage/tidb"
+	"github.com/hunknownz/watchrelay/tracing"
 
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
 )
 
 type WatchRelay struct {
-	seq    *Sequence
+	revs   RevisionAllocator
 	sqlLog *sqllog.SQLLog
 
 	db      *gorm.DB
 	dialect sqllog.Dialect
+	store   sqllog.Store
+
+	opts options
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// ErrCompacted is returned by After and Watch when the requested revision
+// has been compacted.
+var ErrCompacted = sqllog.ErrCompacted
+
+// CompactedError reports the compact revision when ErrCompacted is returned.
+type CompactedError = sqllog.CompactedError
+
+// ErrConflict is returned by Update, Patch and Delete when the resource
+// version of a resource is not its current version.
+var ErrConflict = sqllog.ErrConflict
+
+// ErrNotFound is returned when a resource does not exist.
+var ErrNotFound = sqllog.ErrNotFound
+
+// ConflictError reports the current version when ErrConflict is returned.
+type ConflictError = sqllog.ConflictError
+
+// ErrDatabase is reported by a Watcher when the event log cannot be polled as
+// the database keeps failing.
+var ErrDatabase = sqllog.ErrDatabase
+
+// DatabaseError reports the last error of the database when ErrDatabase is
+// reported.
+type DatabaseError = sqllog.DatabaseError
+
+// ErrNotStarted is returned by reads and watches of a relay that has not been
+// started.
+var ErrNotStarted = sqllog.ErrNotStarted
+
+// ErrEvicted is reported by a Watcher whose consumer did not keep up with the events.
+var ErrEvicted = publisher.ErrEvicted
+
+// ErrClosed is reported by a Watcher when the relay stops.
+var ErrClosed = publisher.ErrClosed
+
+// Watcher streams the events of a watch.
+type Watcher[T resource.IVersionedResource] interface {
+	// ResultChan returns the batches of events. It is closed when the watch ends.
+	ResultChan() <-chan []*event.Event[T]
+	// Stop ends the watch and closes its ResultChan.
+	Stop()
+	// Err returns why the watch ended once its ResultChan is closed: the error
+	// of its context, ErrEvicted, ErrClosed, a *CompactedError, a
+	// *DatabaseError or another database error. It is nil while the watch
+	// runs and after Stop.
+	Err() error
+	// Revision returns the revision the watch started after.
+	Revision() uint64
+}
+
+type watcher[T resource.IVersionedResource] struct {
+	result   chan []*event.Event[T]
+	cancel   context.CancelFunc
+	revision uint64
+
+	mu      sync.Mutex
+	stopped bool
+	err     error
+}
+
+func (wt *watcher[T]) ResultChan() <-chan []*event.Event[T] {
+	return wt.result
+}
+
+func (wt *watcher[T]) Stop() {
+	wt.mu.Lock()
+	wt.stopped = true
+	wt.mu.Unlock()
+	wt.cancel()
 }
 
-type WatchResult[T resource.IVersionedResource] struct {
-	Revision uint64
-	Events   chan []*event.Event[T]
+func (wt *watcher[T]) Err() error {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	return wt.err
+}
+
+func (wt *watcher[T]) Revision() uint64 {
+	return wt.revision
+}
+
+// finish records why the watch ended and closes its result channel.
+func (wt *watcher[T]) finish(err error) {
+	wt.mu.Lock()
+	if !wt.stopped {
+		wt.err = err
+	}
+	wt.mu.Unlock()
+	wt.cancel()
+	close(wt.result)
 }
 
 type ConditionFunc[T resource.IVersionedResource] func(v T) bool
@@ -35,58 +136,279 @@ type ConditionFunc[T resource.IVersionedResource] func(v T) bool
 func RegisterResource[T resource.IVersionedResource](w *WatchRelay) error {
 	var res T
 	resourceName := resource.GetResourceName(res)
-	fn := func(rv, createRv uint64, action event.EventAction, createdAt time.Time, v []byte) (event.IEvent, error) {
-		t := new(T)
-		err := json.Unmarshal(v, t)
-		if err != nil {
-			return nil, err
-		}
-		return &event.Event[T]{
-			Value:          *t,
-			CreateRevision: createRv,
-			Revision:       rv,
-			Action:         action,
-			ResourceName:   resourceName,
-			CreatedAt:      createdAt,
-		}, nil
-	}
-	w.sqlLog.Register(resourceName, fn)
+	w.sqlLog.Register(resourceName, event.NewEventFunc[T](resourceName))
 
 	return nil
 }
 
 // NewWatchRelay creates a new WatchRelay with the given database.
 // If underlying database connection is not a *sql.DB, like in a transaction, it will returns error.
-func NewWatchRelay(db *gorm.DB) (w *WatchRelay, err error) {
+func NewWatchRelay(db *gorm.DB, opts ...Option) (w *WatchRelay, err error) {
 	sqlDB, err := db.DB()
 	if err != nil {
 		return nil, err
 	}
 
+	o := newOptions(opts)
+	if !generic.ValidTableName(o.log.TableName) {
+		return nil, fmt.Errorf("watchrelay: invalid table name %q", o.log.TableName)
+	}
+
 	var (
 		dialect  sqllog.Dialect
 		startRev uint64
 	)
 	switch db.Dialector.Name() {
 	case "mysql":
-		dialect, startRev, err = mysql.New(sqlDB)
+		// TiDB speaks the MySQL protocol and is reached through the MySQL dialector.
+		isTiDB, err := tidb.IsTiDB(sqlDB)
+		if err != nil {
+			return nil, err
+		}
+		if isTiDB {
+			dialect, startRev, err = tidb.New(sqlDB, o.log)
+		} else {
+			dialect, startRev, err = mysql.New(sqlDB, o.log)
+		}
+		if err != nil {
+			return nil, err
+		}
+	case "postgres":
+		dialect, startRev, err = pgsql.New(sqlDB, o.log)
+		if err != nil {
+			return nil, err
+		}
+	case "sqlite":
+		dialect, startRev, err = sqlite.New(sqlDB, o.log)
 		if err != nil {
 			return nil, err
 		}
 	default:
 		return nil, errors.New("watchrelay: unsupported database dialect")
 	}
+	revs, err := o.allocator(db, o.log.TableName, startRev)
+	if err != nil {
+		return nil, err
+	}
+	dialect = sqllog.Traced(dialect, o.log.Tracer)
 
 	w = &WatchRelay{
-		seq:    NewSequence(startRev),
-		sqlLog: sqllog.NewSQLLog(dialect),
-		db:     db,
+		revs:    revs,
+		sqlLog:  sqllog.NewSQLLog(dialect, o.log, startRev),
+		db:      db,
+		dialect: dialect,
+		opts:    o,
+		done:    make(chan struct{}),
 	}
 	return
 }
 
+// NewWatchRelayWithStore creates a new WatchRelay that keeps its event log in store
+// instead of a database, like storage/memory. Resources are not persisted:
+// hooks receive a nil *gorm.DB and only the log events are written.
+func NewWatchRelayWithStore(store sqllog.Store, opts ...Option) (w *WatchRelay, err error) {
+	if store == nil {
+		return nil, errors.New("watchrelay: store is nil")
+	}
+
+	startRev, err := store.CurrentRevision(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	o := newOptions(opts)
+	revs, err := o.allocator(nil, o.log.TableName, startRev)
+	if err != nil {
+		return nil, err
+	}
+	store = sqllog.Traced(store, o.log.Tracer).(sqllog.Store)
+
+	w = &WatchRelay{
+		revs:    revs,
+		sqlLog:  sqllog.NewSQLLog(store, o.log, startRev),
+		dialect: store,
+		store:   store,
+		opts:    o,
+		done:    make(chan struct{}),
+	}
+	return
+}
+
+// Start starts the relay and its background compaction until ctx is done.
 func (w *WatchRelay) Start(ctx context.Context) {
 	w.sqlLog.Start(ctx)
+	if w.opts.compactInterval > 0 {
+		go w.compact(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		w.stopOnce.Do(func() { close(w.done) })
+	}()
+}
+
+// Logger returns the logger of the relay.
+func (w *WatchRelay) Logger() logging.Logger {
+	if w == nil {
+		return logging.Discard()
+	}
+	return w.opts.log.Logger
+}
+
+// Done returns a channel that is closed once the context passed to Start is done.
+func (w *WatchRelay) Done() <-chan struct{} {
+	return w.done
+}
+
+// transaction runs fn and writes the log events it returns atomically with
+// the changes fn made through tx, in a span of the operation op on
+// resourceName. Relays without a database call fn with a nil tx and append
+// the events to their store once fn succeeds. The events carry the trace
+// context of the span, for watchers to link their spans to it, and the
+// annotations of ctx.
+func (w *WatchRelay) transaction(ctx context.Context, op, resourceName string, fn func(ctx context.Context, tx *gorm.DB) ([]*event.LogEvent, error)) (err error) {
+	ctx, span := w.opts.log.Tracer.Start(ctx, "watchrelay."+op, tracing.Attr(tracing.KeyResource, resourceName))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
+	var events []*event.LogEvent
+	if w.db == nil {
+		events, err = fn(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := w.annotate(ctx, events); err != nil {
+			return err
+		}
+		if err := w.store.Append(ctx, events...); err != nil {
+			return err
+		}
+	} else {
+		err := w.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			var err error
+			events, err = fn(ctx, tx)
+			if err != nil {
+				return err
+			}
+			if err := w.annotate(ctx, events); err != nil {
+				return err
+			}
+			return tx.Table(w.opts.log.TableName).Create(events).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	span.SetAttributes(tracing.Attr(tracing.KeyEvents, len(events)))
+	for _, e := range events {
+		w.opts.log.Metrics.EventWritten(e.ResourceName, e.Action().String())
+	}
+	return nil
+}
+
+// annotate sets the trace context and the annotations of ctx on events.
+func (w *WatchRelay) annotate(ctx context.Context, events []*event.LogEvent) error {
+	traceContext, err := w.traceContext(ctx)
+	if err != nil {
+		return err
+	}
+	var annotations datatypes.JSON
+	if a := AnnotationsFromContext(ctx); len(a) > 0 {
+		if annotations, err = json.Marshal(a); err != nil {
+			return err
+		}
+	}
+	for _, e := range events {
+		e.TraceContext, e.Annotations = traceContext, annotations
+	}
+	return nil
+}
+
+// traceContext returns the trace context of ctx encoded for the log events,
+// or nil if it is not propagated.
+func (w *WatchRelay) traceContext(ctx context.Context) (datatypes.JSON, error) {
+	if w.opts.log.Propagator == nil {
+		return nil, nil
+	}
+
+	carrier := tracing.MapCarrier{}
+	w.opts.log.Propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(carrier)
+}
+
+// newLogEvent builds the log event recording res at its current resource version.
+func newLogEvent[T resource.IVersionedResource](resourceName string, action event.EventAction, res T, now time.Time) (*event.LogEvent, error) {
+	b, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+
+	return &event.LogEvent{
+		Revision:     res.GetResourceVersion(),
+		ResourceName: resourceName,
+		Created:      action == event.EventActionCreate,
+		Deleted:      action == event.EventActionDelete,
+		Value:        datatypes.JSON(b),
+		CreatedAt:    now,
+	}, nil
+}
+
+// chain links events recording changes to existing objects to the histories
+// of the objects, prevRevs holding the revisions the objects had before the
+// change. An object without an event at its previous revision, e.g. written
+// before it was relayed, starts a new history.
+func (w *WatchRelay) chain(ctx context.Context, tx *gorm.DB, events []*event.LogEvent, prevRevs []uint64) error {
+	prevEvents, err := w.logEvents(ctx, tx, prevRevs, "revision", "create_revision")
+	if err != nil {
+		return err
+	}
+
+	createRevs := make(map[uint64]uint64, len(prevEvents))
+	for _, e := range prevEvents {
+		createRevs[e.Revision] = e.CreateRevision
+	}
+
+	for i, e := range events {
+		e.PrevRevision = prevRevs[i]
+		if createRev, ok := createRevs[prevRevs[i]]; ok {
+			e.CreateRevision = createRev
+		} else {
+			e.CreateRevision = e.Revision
+		}
+	}
+	return nil
+}
+
+// logEvents returns the columns of the log events at revisions, read with db
+// or from the store of a relay without a database.
+func (w *WatchRelay) logEvents(ctx context.Context, db *gorm.DB, revisions []uint64, columns ...string) ([]*event.LogEvent, error) {
+	if db == nil {
+		return w.store.Get(ctx, revisions...)
+	}
+
+	var events []*event.LogEvent
+	// Chunked to stay below the limits of the databases on bound parameters.
+	for len(revisions) > 0 {
+		n := len(revisions)
+		if n > 1000 {
+			n = 1000
+		}
+		var chunk []*event.LogEvent
+		err := db.Table(w.opts.log.TableName).Select(columns).Where("revision IN ?", revisions[:n]).Find(&chunk).Error
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, chunk...)
+		revisions = revisions[n:]
+	}
+	return events, nil
 }
 
 // BatchHook is executed before or after creating, updating, or deleting resources in the database.
@@ -110,63 +432,65 @@ func Create[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, b
 		return fmt.Errorf("watchrelay: resource %s not registered", resourceName)
 	}
 
-	db := w.db
-
-	fn := func(tx *gorm.DB) error {
+	fn := func(ctx context.Context, tx *gorm.DB) ([]*event.LogEvent, error) {
 		if beforeCreate != nil {
 			err := beforeCreate(tx, resources...)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
 
 		events := make([]*event.LogEvent, len(resources))
 		for i, res := range resources {
-			res.SetResourceVersion(w.seq.Next())
-
-			b, err := json.Marshal(res)
+			rev, err := w.revs.Allocate(ctx, tx)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			value := datatypes.JSON(b)
-
-			events[i] = &event.LogEvent{
-				Revision:       res.GetResourceVersion(),
-				CreateRevision: res.GetResourceVersion(),
-				PrevRevision:   0,
-				ResourceName:   resourceName,
-				Created:        true,
-				Deleted:        false,
-				Value:          value,
-				CreatedAt:      time.Now(),
+			res.SetResourceVersion(rev)
+
+			e, err := newLogEvent(resourceName, event.EventActionCreate, res, w.opts.log.Clock.Now())
+			if err != nil {
+				return nil, err
 			}
+			e.CreateRevision = e.Revision
+			events[i] = e
 		}
 
-		if err := tx.Create(resources).Error; err != nil {
-			tx.Rollback()
-			return err
-		}
-		if err := tx.Create(events).Error; err != nil {
-			tx.Rollback()
-			return err
+		if tx != nil {
+			if err := relayed(tx).Create(resources).Error; err != nil {
+				return nil, err
+			}
 		}
 
 		if afterCreate != nil {
 			err := afterCreate(tx, resources...)
 			if err != nil {
-				tx.Rollback()
-				return err
+				return nil, err
 			}
 		}
 
-		return nil
+		return events, nil
 	}
 
-	return db.WithContext(ctx).Transaction(fn)
+	return w.transaction(ctx, "Create", resourceName, fn)
 }
 
-// Update updates resources and event logs in the database.
+// Update updates resources and event logs in the database. All fields of res
+// are written.
 func Update[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, beforeUpdate, afterUpdate Hook[T], res T) error {
+	return update(w, ctx, "Update", beforeUpdate, afterUpdate, res, false)
+}
+
+// Patch updates the non-zero fields of res, like gorm's Updates, and logs the
+// resulting row, which res is set to. Relays without a database have no row
+// to patch and log res as it is.
+func Patch[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, beforePatch, afterPatch Hook[T], res T) error {
+	return update(w, ctx, "Patch", beforePatch, afterPatch, res, true)
+}
+
+// update writes res at a new revision for Update and Patch, the operation op.
+// With patch, only its non-zero fields are written.
+func update[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, op string, beforeUpdate, afterUpdate Hook[T], res T, patch bool) error {
 	if w == nil {
 		return errors.New("watchrelay: WatchRelay is nil")
 	}
@@ -176,78 +500,65 @@ func Update[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, b
 		return fmt.Errorf("watchrelay: resource %s not registered", resourceName)
 	}
 
-	db := w.db
-	tx := db.Begin()
+	prevRev := res.GetResourceVersion()
+	fn := func(ctx context.Context, tx *gorm.DB) ([]*event.LogEvent, error) {
+		if beforeUpdate != nil {
+			err := beforeUpdate(tx, res)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-	if beforeUpdate != nil {
-		err := beforeUpdate(tx, res)
+		rev, err := w.revs.Allocate(ctx, tx)
 		if err != nil {
-			tx.Rollback()
-			return err
+			return nil, err
 		}
-	}
-
-	res.SetResourceVersion(w.seq.Next())
-
-	event := &event.Event[T]{
-		Revision:     res.GetResourceVersion(),
-		ResourceName: resourceName,
-		Action:       event.EventActionUpdate,
-		Value:        res,
-	}
-
-	if err := tx.Save(res).Error; err != nil {
-		tx.Rollback()
-		return err
-	}
-	if err := tx.Create(event).Error; err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	return tx.Commit().Error
-}
+		res.SetResourceVersion(rev)
 
-func Patch[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, beforePatch, afterPatch Hook[T], res T) error {
-	if w == nil {
-		return errors.New("watchrelay: WatchRelay is nil")
-	}
-
-	resourceName := resource.GetResourceName(res)
-	if !w.sqlLog.IsRegisterd(resourceName) {
-		return fmt.Errorf("watchrelay: resource %s not registered", resourceName)
-	}
-
-	db := w.db
-	tx := db.Begin()
+		if tx != nil {
+			db := relayed(tx).Model(res).Where("resource_version = ?", prevRev)
+			if !patch {
+				db = db.Select("*")
+			}
+			result := db.Updates(res)
+			if result.Error != nil {
+				return nil, result.Error
+			}
+			if result.RowsAffected == 0 {
+				return nil, conflict(tx, res, prevRev)
+			}
+			if patch {
+				if err := tx.Take(res).Error; err != nil {
+					return nil, err
+				}
+			}
+		}
 
-	if beforePatch != nil {
-		err := beforePatch(tx, res)
+		e, err := newLogEvent(resourceName, event.EventActionUpdate, res, w.opts.log.Clock.Now())
 		if err != nil {
-			tx.Rollback()
-			return err
+			return nil, err
+		}
+		events := []*event.LogEvent{e}
+		if err := w.chain(ctx, tx, events, []uint64{prevRev}); err != nil {
+			return nil, err
 		}
-	}
 
-	res.SetResourceVersion(w.seq.Next())
+		if afterUpdate != nil {
+			err := afterUpdate(tx, res)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-	event := &event.Event[T]{
-		Revision:     res.GetResourceVersion(),
-		ResourceName: resource.GetResourceName(res),
-		Action:       event.EventActionUpdate,
-		Value:        res,
+		return events, nil
 	}
 
-	if err := tx.Save(res).Error; err != nil {
-		tx.Rollback()
-		return err
-	}
-	if err := tx.Create(event).Error; err != nil {
-		tx.Rollback()
-		return err
+	err := w.transaction(ctx, op, resourceName, fn)
+	if err != nil {
+		// Leave res as it was, so that the write can be retried.
+		res.SetResourceVersion(prevRev)
 	}
-
-	return tx.Commit().Error
+	return err
 }
 
 // Delete deletes resources and event logs in the database.
@@ -265,50 +576,112 @@ func Delete[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, b
 		return fmt.Errorf("watchrelay: resource %s not registered", resourceName)
 	}
 
-	db := w.db
-	tx := db.Begin()
+	prevRevs := make([]uint64, len(resources))
+	for i, res := range resources {
+		prevRevs[i] = res.GetResourceVersion()
+	}
+	fn := func(ctx context.Context, tx *gorm.DB) ([]*event.LogEvent, error) {
+		if beforeDelete != nil {
+			err := beforeDelete(tx, resources...)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		events := make([]*event.LogEvent, len(resources))
+		for i, res := range resources {
+			rev, err := w.revs.Allocate(ctx, tx)
+			if err != nil {
+				return nil, err
+			}
+			res.SetResourceVersion(rev)
 
-	if beforeDelete != nil {
-		err := beforeDelete(tx, resources...)
-		if err != nil {
-			tx.Rollback()
-			return err
+			e, err := newLogEvent(resourceName, event.EventActionDelete, res, w.opts.log.Clock.Now())
+			if err != nil {
+				return nil, err
+			}
+			events[i] = e
+		}
+		if err := w.chain(ctx, tx, events, prevRevs); err != nil {
+			return nil, err
 		}
-	}
 
-	events := make([]*event.Event[T], len(resources))
-	for i, res := range resources {
-		res.SetResourceVersion(w.seq.Next())
+		if tx != nil {
+			for i, res := range resources {
+				result := deleteRow(tx, resourceName, res, prevRevs[i])
+				if result.Error != nil {
+					return nil, result.Error
+				}
+				if result.RowsAffected == 0 {
+					return nil, conflict(tx, res, prevRevs[i])
+				}
+			}
+		}
 
-		events[i] = &event.Event[T]{
-			Revision:     res.GetResourceVersion(),
-			ResourceName: resourceName,
-			Action:       event.EventActionDelete,
-			Value:        res,
+		if afterDelete != nil {
+			err := afterDelete(tx, resources...)
+			if err != nil {
+				return nil, err
+			}
 		}
-	}
 
-	if err := tx.Delete(resources).Error; err != nil {
-		tx.Rollback()
-		return err
+		return events, nil
 	}
-	if err := tx.Create(events).Error; err != nil {
-		tx.Rollback()
-		return err
+
+	err := w.transaction(ctx, "Delete", resourceName, fn)
+	if err != nil {
+		// Leave resources as they were, so that the write can be retried.
+		for i, res := range resources {
+			res.SetResourceVersion(prevRevs[i])
+		}
 	}
+	return err
+}
 
-	if afterDelete != nil {
-		err := afterDelete(tx, resources...)
-		if err != nil {
-			tx.Rollback()
-			return err
+// deleteRow deletes the row of res if it is at prevRev. Soft deleted rows are
+// kept at the revision of their delete, written by the same UPDATE.
+func deleteRow[T resource.IVersionedResource](tx *gorm.DB, resourceName string, res T, prevRev uint64) *gorm.DB {
+	tx = relayed(tx).Where("resource_version = ?", prevRev)
+
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(res); err != nil {
+		tx.AddError(err)
+		return tx
+	}
+	for _, c := range stmt.Schema.DeleteClauses {
+		if sd, ok := c.(gorm.SoftDeleteDeleteClause); ok {
+			field, err := versionField(stmt, resourceName)
+			if err != nil {
+				tx.AddError(err)
+				return tx
+			}
+			return tx.Model(res).UpdateColumns(map[string]any{
+				sd.Field.DBName: tx.NowFunc(),
+				field.DBName:    res.GetResourceVersion(),
+			})
 		}
 	}
+	return tx.Delete(res)
+}
 
-	return tx.Commit().Error
+// versionField returns the field of the resource version of the model of stmt.
+func versionField(stmt *gorm.Statement, resourceName string) (*schema.Field, error) {
+	field := stmt.Schema.LookUpField("ResourceVersion")
+	if field == nil {
+		return nil, fmt.Errorf("watchrelay: resource %s has no ResourceVersion column", resourceName)
+	}
+	return field, nil
 }
 
+// After returns the events of T satisfying cond after revision rev, and the
+// newest revision of the log. Revision 0 reads from the oldest event kept by
+// compaction; ErrCompacted is returned for any other revision that has been
+// compacted.
 func After[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, cond ConditionFunc[T], rev uint64, limit int64) (uint64, []*event.Event[T], error) {
+	return after(w, ctx, cond, rev, sqllog.AfterOptions{Limit: limit, FromOldest: rev == 0})
+}
+
+func after[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, cond ConditionFunc[T], rev uint64, opts sqllog.AfterOptions) (uint64, []*event.Event[T], error) {
 	if w == nil {
 		return 0, nil, errors.New("watchrelay: WatchRelay is nil")
 	}
@@ -318,15 +691,18 @@ func After[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, co
 	if !w.sqlLog.IsRegisterd(resourceName) {
 		return 0, nil, fmt.Errorf("watchrelay: resource %s not registered", resourceName)
 	}
-	rev, iEvents, err := w.sqlLog.After(ctx, resourceName, rev, limit)
+	rev, iEvents, err := w.sqlLog.After(ctx, resourceName, rev, opts)
 	if err != nil {
 		return 0, nil, err
 	}
 	events := make([]*event.Event[T], 0, len(iEvents))
 	for i := range iEvents {
+		if iEvents[i].IsGap() {
+			continue
+		}
 		event, ok := iEvents[i].(*event.Event[T])
 		if !ok {
-			logrus.Errorf("watchrelay: invalid event type %T", iEvents[i])
+			w.opts.log.Logger.WithContext(ctx).Error("watchrelay: invalid event type", logging.KeyResource, resourceName, logging.KeyRevision, iEvents[i].GetRevision(), "type", fmt.Sprintf("%T", iEvents[i]))
 			continue
 		}
 		if cond != nil && !cond(event.Value) {
@@ -338,72 +714,373 @@ func After[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, co
 	return rev, events, nil
 }
 
-func Watch[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, cond ConditionFunc[T], rev uint64) WatchResult[T] {
-	eventFilter := func(events []*event.Event[T]) ([]*event.Event[T], bool) {
-		if cond == nil {
-			return events, true
-		}
+// replay returns the events after rev up to the consistent revision, along
+// with the revision replayed to. The subscriber of the watch must be subscribed
+// first: the events after the consistent revision are sent to it. Revisions
+// above are left out even if they are committed, as a lower revision may
+// still commit after them.
+func replay[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, cond ConditionFunc[T], rev uint64, opts sqllog.AfterOptions) (uint64, []*event.Event[T], error) {
+	consistentRev, err := w.sqlLog.ConsistentRevision(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	_, events, err := after[T](w, ctx, cond, rev, opts)
+	if err != nil {
+		return 0, nil, err
+	}
+	n := len(events)
+	for n > 0 && events[n-1].Revision > consistentRev {
+		n--
+	}
+	if consistentRev < rev {
+		consistentRev = rev
+	}
+	return consistentRev, events[:n], nil
+}
 
-		filtered := make([]*event.Event[T], 0, len(events))
-		for _, event := range events {
-			v := event.GetValue().(T)
-			if cond(v) {
-				filtered = append(filtered, event)
-			}
-		}
-		return filtered, len(filtered) > 0
+// Watch sends the events of T satisfying cond from revision rev on, replaying
+// the event log before following new events.
+func Watch[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, cond ConditionFunc[T], rev uint64, opts ...WatchOption) Watcher[T] {
+	o := newWatchOptions(opts)
+	log := resourceLogger[T](w, ctx)
+
+	bufferSize := o.subscribe.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = w.opts.log.BufferSize
 	}
 
-	// start watch
 	ctx, cancel := context.WithCancel(ctx)
-	readCh := sqllog.Watch[T](w.sqlLog, ctx, eventFilter)
+	wt := &watcher[T]{
+		result: make(chan []*event.Event[T], bufferSize),
+		cancel: cancel,
+	}
 
-	// should contain current resource version
-	if rev > 0 {
-		rev--
+	// start watch
+	sub, err := subscribe[T](w, ctx, o)
+	if err != nil {
+		log.Error("watchrelay: failed to subscribe to events", logging.KeyError, err)
+		wt.finish(err)
+		return wt
 	}
 
-	results := make(chan []*event.Event[T], 128)
-	watchResult := WatchResult[T]{
-		Revision: rev,
-		Events:   results,
+	// Only a watch from revision 0 starts with whatever history is left; a
+	// watch from revision 1 is decremented to 0 but misses compacted events.
+	fromOldest := rev == 0
+	var initial []*event.Event[T]
+	if o.initialEvents {
+		items, listRev, err := List[T](w, ctx, cond)
+		if err != nil {
+			log.Error("watchrelay: failed to list initial events", logging.KeySubscriber, sub.ID(), logging.KeyError, err)
+			wt.finish(err)
+			return wt
+		}
+		initial, err = initialEvents(w, ctx, items)
+		if err != nil {
+			log.Error("watchrelay: failed to list initial events", logging.KeySubscriber, sub.ID(), logging.KeyError, err)
+			wt.finish(err)
+			return wt
+		}
+		rev = listRev
+		fromOldest = false
+	} else if rev > 0 {
+		// should contain current resource version
+		rev--
 	}
+	wt.revision = rev
 
-	curRev, events, err := After[T](w, ctx, cond, rev, 0)
+	replayedRev, events, err := replay[T](w, ctx, cond, rev, sqllog.AfterOptions{FromOldest: fromOldest, PrevValue: o.prevValue})
 	if err != nil {
-		logrus.Errorf("watchrelay: failed to list events after revision %d: %v", rev, err)
-		cancel()
+		log.Error("watchrelay: failed to list events", logging.KeySubscriber, sub.ID(), logging.KeyRevision, rev, logging.KeyError, err)
+		wt.finish(err)
+		return wt
 	}
 
 	go func() {
-		defer func() {
-			close(results)
-			cancel()
-		}()
+		emit := func(events []*event.Event[T]) bool {
+			select {
+			case wt.result <- decorate(log, o, events):
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		// The list may already reflect changes after its revision; their
+		// events are left out until the watch is past the listed versions.
+		listed, listedRev := listedVersions(initial)
+		send := func(events []*event.Event[T]) bool {
+			if listed != nil && len(events) > 0 {
+				last := events[len(events)-1].Revision
+				events = skipListed(events, listed)
+				if last >= listedRev {
+					listed = nil
+				}
+			}
+			events = selectAnnotated(events, o.annotations)
+			return len(events) == 0 || emit(events)
+		}
 
-		lastRev := rev
-		if len(events) > 0 {
-			lastRev = curRev
+		lastRev := replayedRev
+		// deliver sends the events of a batch received from the subscriber.
+		deliver := func(value []*event.Event[T]) bool {
+			events, ok := filter(value, lastRev, cond)
+			if len(value) > 0 && value[len(value)-1].Revision > lastRev {
+				lastRev = value[len(value)-1].Revision
+			}
+			return !ok || send(events)
 		}
 
-		if len(events) > 0 {
-			results <- events
+		// retry resumes the watch after err if it can be, and finishes it
+		// otherwise, reporting whether it goes on.
+		retry := func(err error) bool {
+			if !o.resume || errors.Is(err, ErrCompacted) || ctx.Err() != nil {
+				wt.finish(err)
+				return false
+			}
+
+			log.Debug("watchrelay: resuming watch", logging.KeySubscriber, sub.ID(), logging.KeyRevision, lastRev, logging.KeyError, err)
+			sub.cancel()
+			sub, err = resume(w, ctx, o, cond, &lastRev, send)
+			if err != nil {
+				wt.finish(err)
+				return false
+			}
+			return true
+		}
+
+		// The initial events are the state of the resources rather than
+		// changes, so they are not selected by annotations.
+		if o.initialEvents && !emit(initial) {
+			wt.finish(ctx.Err())
+			return
+		}
+		if len(events) > 0 && !send(events) {
+			wt.finish(ctx.Err())
+			return
 		}
 
-		for value := range readCh {
-			events, ok := filter[T](value, lastRev)
-			if !ok {
-				results <- events
+		for {
+			select {
+			case value, ok := <-sub.C():
+				if !ok {
+					if !retry(sub.Err()) {
+						return
+					}
+					continue
+				}
+
+				if !deliver(value) {
+					wt.finish(ctx.Err())
+					return
+				}
+			case <-sub.Lag():
+				// Deliver the events buffered before the subscriber started
+				// lagging, then catch up with the dropped ones from the log.
+				for drained := false; !drained; {
+					select {
+					case value, ok := <-sub.C():
+						if ok && !deliver(value) {
+							wt.finish(ctx.Err())
+							return
+						}
+						drained = !ok
+					default:
+						drained = true
+					}
+				}
+				sub.Resume()
+
+				replayedRev, events, err := replay[T](w, ctx, cond, lastRev, sqllog.AfterOptions{PrevValue: o.prevValue})
+				if err != nil {
+					log.Error("watchrelay: failed to catch up", logging.KeySubscriber, sub.ID(), logging.KeyRevision, lastRev, logging.KeyError, err)
+					if !retry(err) {
+						return
+					}
+					continue
+				}
+				if !send(events) {
+					wt.finish(ctx.Err())
+					return
+				}
+				lastRev = replayedRev
+			case <-ctx.Done():
+				wt.finish(ctx.Err())
+				return
 			}
 		}
 	}()
 
-	return watchResult
+	return wt
+}
+
+// subscription is a subscriber to the events of a watch, closed with its own
+// context so that it can be dropped when the watch resumes.
+type subscription[T resource.IVersionedResource] struct {
+	*publisher.Subscriber[T]
+	cancel context.CancelFunc
+}
+
+func subscribe[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, o watchOptions) (subscription[T], error) {
+	ctx, cancel := context.WithCancel(ctx)
+	sub, err := sqllog.Watch[T](w.sqlLog, ctx, sqllog.WatchOptions{SubscribeOptions: o.subscribe, PrevValue: o.prevValue})
+	if err != nil {
+		cancel()
+		return subscription[T]{}, err
+	}
+	return subscription[T]{Subscriber: sub, cancel: cancel}, nil
 }
 
-func filter[T resource.IVersionedResource](events []*event.Event[T], rev uint64) ([]*event.Event[T], bool) {
+// resume subscribes again and sends the events after *lastRev missed in
+// between, retrying with backoff until it succeeds or cannot succeed.
+func resume[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, o watchOptions, cond ConditionFunc[T], lastRev *uint64, send func([]*event.Event[T]) bool) (subscription[T], error) {
+	delay := o.minBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return subscription[T]{}, ctx.Err()
+		case <-w.Done():
+			return subscription[T]{}, ErrClosed
+		case <-time.After(delay):
+		}
+
+		sub, err := subscribe[T](w, ctx, o)
+		if err == nil {
+			var (
+				replayedRev uint64
+				events      []*event.Event[T]
+			)
+			replayedRev, events, err = replay[T](w, ctx, cond, *lastRev, sqllog.AfterOptions{PrevValue: o.prevValue})
+			if err == nil {
+				if !send(events) {
+					sub.cancel()
+					return subscription[T]{}, ctx.Err()
+				}
+				*lastRev = replayedRev
+				return sub, nil
+			}
+			sub.cancel()
+			if errors.Is(err, ErrCompacted) {
+				return subscription[T]{}, err
+			}
+		}
+		if ctx.Err() != nil {
+			return subscription[T]{}, ctx.Err()
+		}
+
+		resourceLogger[T](w, ctx).Error("watchrelay: failed to resume watch, retrying", logging.KeyRevision, *lastRev, "delay", delay, logging.KeyError, err)
+		if delay *= 2; delay > o.maxBackoff {
+			delay = o.maxBackoff
+		}
+	}
+}
+
+// resourceLogger returns the logger of the relay with the resource name of T.
+func resourceLogger[T resource.IVersionedResource](w *WatchRelay, ctx context.Context) logging.Logger {
+	var v T
+	return w.opts.log.Logger.With(logging.KeyResource, resource.GetResourceName(v)).WithContext(ctx)
+}
+
+// initialEvents returns the synthetic create events of listed resources,
+// with the create revision and time of the newest log event of each.
+func initialEvents[T resource.IVersionedResource](w *WatchRelay, ctx context.Context, items []T) ([]*event.Event[T], error) {
+	revisions := make([]uint64, len(items))
+	for i, item := range items {
+		revisions[i] = item.GetResourceVersion()
+	}
+	var db *gorm.DB
+	if w.db != nil {
+		db = w.db.WithContext(ctx)
+	}
+	logEvents, err := w.logEvents(ctx, db, revisions, "revision", "create_revision", "created_at")
+	if err != nil {
+		return nil, err
+	}
+	byRevision := make(map[uint64]*event.LogEvent, len(logEvents))
+	for _, e := range logEvents {
+		byRevision[e.Revision] = e
+	}
+
+	events := make([]*event.Event[T], len(items))
+	for i, item := range items {
+		e := &event.Event[T]{
+			Revision:     item.GetResourceVersion(),
+			ResourceName: resource.GetResourceName(item),
+			Action:       event.EventActionCreate,
+			Value:        item,
+		}
+		// Resources written outside the relay have no log event.
+		if logEvent, ok := byRevision[e.Revision]; ok {
+			e.CreateRevision = logEvent.CreateRevision
+			e.CreatedAt = logEvent.CreatedAt
+		}
+		events[i] = e
+	}
+	return events, nil
+}
+
+// listedVersions maps the create revisions of the initial events to their
+// listed versions, and returns the newest of them.
+func listedVersions[T resource.IVersionedResource](initial []*event.Event[T]) (map[uint64]uint64, uint64) {
+	if len(initial) == 0 {
+		return nil, 0
+	}
+	listed := make(map[uint64]uint64, len(initial))
+	var newest uint64
+	for _, e := range initial {
+		if e.CreateRevision != 0 {
+			listed[e.CreateRevision] = e.Revision
+		}
+		if e.Revision > newest {
+			newest = e.Revision
+		}
+	}
+	return listed, newest
+}
+
+// skipListed leaves out the events already reflected by the listed versions.
+func skipListed[T resource.IVersionedResource](events []*event.Event[T], listed map[uint64]uint64) []*event.Event[T] {
+	kept := events[:0:0]
+	for _, e := range events {
+		if version, ok := listed[e.CreateRevision]; ok && e.Revision <= version {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// decorate returns the events as requested by the watch options. Events are
+// shared between watches, so they are copied rather than modified.
+func decorate[T resource.IVersionedResource](log logging.Logger, o watchOptions, events []*event.Event[T]) []*event.Event[T] {
+	if !o.prevValue {
+		return events
+	}
+
+	decorated := make([]*event.Event[T], len(events))
+	for i, e := range events {
+		withPrev, err := e.WithPrevValue()
+		if err != nil {
+			log.Error("watchrelay: failed to decode previous value", logging.KeyRevision, e.Revision, logging.KeyError, err)
+			withPrev = e
+		}
+		decorated[i] = withPrev
+	}
+	return decorated
+}
+
+// filter drops the events at or before rev and those not satisfying cond.
+func filter[T resource.IVersionedResource](events []*event.Event[T], rev uint64, cond ConditionFunc[T]) ([]*event.Event[T], bool) {
 	for len(events) > 0 && events[0].Revision <= rev {
 		events = events[1:]
 	}
-	return events, len(events) > 0
+	if cond == nil {
+		return events, len(events) > 0
+	}
+
+	filtered := make([]*event.Event[T], 0, len(events))
+	for _, e := range events {
+		if cond(e.Value) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered, len(filtered) > 0
 }
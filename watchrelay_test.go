@@ -0,0 +1,706 @@
+package watchrelay_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	wr "github.com/hunknownz/watchrelay"
+	"github.com/hunknownz/watchrelay/event"
+	"github.com/hunknownz/watchrelay/logging"
+	"github.com/hunknownz/watchrelay/resource"
+	"github.com/hunknownz/watchrelay/sqllog"
+	"github.com/hunknownz/watchrelay/storage/memory"
+	"github.com/hunknownz/watchrelay/tracing"
+
+	"gorm.io/gorm"
+)
+
+type Task struct {
+	resource.Meta
+	Name  string
+	Owner string
+}
+
+// newMemoryRelay returns a started relay keeping its log in memory.
+func newMemoryRelay(t *testing.T, opts ...wr.Option) *wr.WatchRelay {
+	t.Helper()
+	return newStoreRelay(t, memory.New(), opts...)
+}
+
+// newStoreRelay returns a started relay of Tasks keeping its log in store.
+func newStoreRelay(t *testing.T, store sqllog.Store, opts ...wr.Option) *wr.WatchRelay {
+	t.Helper()
+
+	opts = append([]wr.Option{wr.WithPollInterval(10 * time.Millisecond)}, opts...)
+	w, err := wr.NewWatchRelayWithStore(store, opts...)
+	if err != nil {
+		t.Fatalf("NewWatchRelayWithStore: %v", err)
+	}
+	if err := wr.RegisterResource[*Task](w); err != nil {
+		t.Fatalf("RegisterResource: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	w.Start(ctx)
+	return w
+}
+
+// receive reads n events from wt, failing the test if they do not arrive.
+func receive[T resource.IVersionedResource](t *testing.T, wt wr.Watcher[T], n int) []*event.Event[T] {
+	t.Helper()
+
+	var events []*event.Event[T]
+	timeout := time.After(5 * time.Second)
+	for len(events) < n {
+		select {
+		case batch, ok := <-wt.ResultChan():
+			if !ok {
+				t.Fatalf("watch ended after %d events: %v", len(events), wt.Err())
+			}
+			events = append(events, batch...)
+		case <-timeout:
+			t.Fatalf("received %d events, want %d", len(events), n)
+		}
+	}
+	if len(events) != n {
+		t.Fatalf("received %d events, want %d", len(events), n)
+	}
+	return events
+}
+
+type wantEvent struct {
+	action         event.EventAction
+	revision       uint64
+	createRevision uint64
+	prevRevision   uint64
+	name           string
+}
+
+func checkEvents(t *testing.T, events []*event.Event[*Task], want []wantEvent) {
+	t.Helper()
+
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, e := range events {
+		w := want[i]
+		if e.Action != w.action || e.Revision != w.revision || e.CreateRevision != w.createRevision || e.PrevRevision != w.prevRevision {
+			t.Errorf("event %d: got %s rev=%d create=%d prev=%d, want %s rev=%d create=%d prev=%d", i,
+				e.Action, e.Revision, e.CreateRevision, e.PrevRevision, w.action, w.revision, w.createRevision, w.prevRevision)
+		}
+		if e.Value.Name != w.name || e.Value.GetResourceVersion() != w.revision {
+			t.Errorf("event %d: got value %+v, want name %q at version %d", i, e.Value, w.name, w.revision)
+		}
+	}
+}
+
+func TestMemoryCreateUpdateDeleteWatch(t *testing.T) {
+	w := newMemoryRelay(t)
+	ctx := context.Background()
+
+	wt := wr.Watch[*Task](w, ctx, nil, 0)
+	defer wt.Stop()
+
+	a, b := &Task{Name: "a"}, &Task{Name: "b"}
+	if err := wr.Create[*Task](w, ctx, nil, nil, a, b); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	a.Owner = "alice"
+	if err := wr.Update[*Task](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := wr.Delete[*Task](w, ctx, nil, nil, b); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	checkEvents(t, receive(t, wt, 4), []wantEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+		{event.EventActionCreate, 2, 2, 0, "b"},
+		{event.EventActionUpdate, 3, 1, 1, "a"},
+		{event.EventActionDelete, 4, 2, 2, "b"},
+	})
+
+	stale := &Task{Name: "a"}
+	stale.SetResourceVersion(1)
+	if err := wr.Update[*Task](w, ctx, nil, nil, stale); err == nil {
+		t.Fatal("Update from a stale version succeeded")
+	}
+}
+
+func TestMemoryWatchFromRevision(t *testing.T) {
+	w := newMemoryRelay(t)
+	ctx := context.Background()
+
+	a := &Task{Name: "a"}
+	if err := wr.Create[*Task](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	a.Owner = "alice"
+	if err := wr.Update[*Task](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	// Watching from the revision of the update replays it from the log
+	// before following new events.
+	wt := wr.Watch[*Task](w, ctx, nil, 2)
+	defer wt.Stop()
+
+	if err := wr.Delete[*Task](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	checkEvents(t, receive(t, wt, 2), []wantEvent{
+		{event.EventActionUpdate, 2, 1, 1, "a"},
+		{event.EventActionDelete, 3, 1, 2, "a"},
+	})
+}
+
+func TestMemoryWatchCompacted(t *testing.T) {
+	store := memory.New()
+	w := newStoreRelay(t, store)
+	ctx := context.Background()
+
+	a := &Task{Name: "a"}
+	if err := wr.Create[*Task](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for _, owner := range []string{"alice", "bob"} {
+		a.Owner = owner
+		if err := wr.Update[*Task](w, ctx, nil, nil, a); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+	}
+	if _, err := store.ClearExpiredEvents(ctx, 0); err != nil {
+		t.Fatalf("ClearExpiredEvents: %v", err)
+	}
+
+	// The history from revision 1 is gone.
+	wt := wr.Watch[*Task](w, ctx, nil, 1)
+	for range wt.ResultChan() {
+	}
+	if err := wt.Err(); !errors.Is(err, wr.ErrCompacted) {
+		t.Fatalf("watch from revision 1 ended with %v, want ErrCompacted", err)
+	}
+
+	// Revision 0 starts with whatever history is left.
+	wt = wr.Watch[*Task](w, ctx, nil, 0)
+	defer wt.Stop()
+	checkEvents(t, receive(t, wt, 2), []wantEvent{
+		{event.EventActionUpdate, 2, 1, 1, "a"},
+		{event.EventActionUpdate, 3, 1, 2, "a"},
+	})
+}
+
+func TestMemoryCompactDeleted(t *testing.T) {
+	store := memory.New()
+	w := newStoreRelay(t, store)
+	ctx := context.Background()
+
+	a, b := &Task{Name: "a"}, &Task{Name: "b"}
+	if err := wr.Create[*Task](w, ctx, nil, nil, a, b); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := wr.Delete[*Task](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	b.Owner = "bob"
+	if err := wr.Update[*Task](w, ctx, nil, nil, b); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	// Compacting up to revision 3 drops the create and delete events of a.
+	n, err := store.ClearExpiredEvents(ctx, 0)
+	if err != nil {
+		t.Fatalf("ClearExpiredEvents: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("deleted %d events, want 2", n)
+	}
+	_, events, err := wr.After[*Task](w, ctx, nil, 0, 0)
+	if err != nil {
+		t.Fatalf("After: %v", err)
+	}
+	checkEvents(t, events, []wantEvent{
+		{event.EventActionCreate, 2, 2, 0, "b"},
+		{event.EventActionUpdate, 4, 2, 2, "b"},
+	})
+}
+
+// createHeld creates a task in the background, holding it after its revision is
+// allocated until release is closed. The returned channel reports its error.
+func createHeld(t *testing.T, w *wr.WatchRelay, task *Task, release <-chan struct{}) <-chan error {
+	t.Helper()
+
+	allocated := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- wr.Create[*Task](w, context.Background(), nil, func(*gorm.DB, ...*Task) error {
+			close(allocated)
+			<-release
+			return nil
+		}, task)
+	}()
+	<-allocated
+	return done
+}
+
+func TestMemoryWatchOutOfOrderCommit(t *testing.T) {
+	w := newMemoryRelay(t)
+	ctx := context.Background()
+
+	// Revision 2 commits while revision 1 is still running.
+	release := make(chan struct{})
+	done := createHeld(t, w, &Task{Name: "a"}, release)
+	if err := wr.Create[*Task](w, ctx, nil, nil, &Task{Name: "b"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// The watch replays the log while revision 1 is missing from it.
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	wt := wr.Watch[*Task](w, ctx, nil, 0)
+	defer wt.Stop()
+	if err := <-done; err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	checkEvents(t, receive(t, wt, 2), []wantEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+		{event.EventActionCreate, 2, 2, 0, "b"},
+	})
+}
+
+func TestMemoryWatchPrevValue(t *testing.T) {
+	w := newMemoryRelay(t)
+	ctx := context.Background()
+
+	withPrev := wr.Watch[*Task](w, ctx, nil, 0, wr.WithPrevValue())
+	defer withPrev.Stop()
+	plain := wr.Watch[*Task](w, ctx, nil, 0)
+	defer plain.Stop()
+
+	a := &Task{Name: "a", Owner: "alice"}
+	if err := wr.Create[*Task](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	a.Owner = "bob"
+	if err := wr.Update[*Task](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	events := receive(t, withPrev, 2)
+	if prev := events[1].PrevValue; prev == nil || prev.Owner != "alice" {
+		t.Errorf("update event has previous value %+v, want owner alice", prev)
+	}
+	events = receive(t, plain, 2)
+	if prev := events[1].PrevValue; prev != nil {
+		t.Errorf("update event of a watch without WithPrevValue has previous value %+v", prev)
+	}
+}
+
+func TestMemoryWatchInitialEvents(t *testing.T) {
+	w := newMemoryRelay(t)
+	ctx := context.Background()
+
+	a, b := &Task{Name: "a"}, &Task{Name: "b"}
+	if err := wr.Create[*Task](w, ctx, nil, nil, a, b); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	a.Owner = "alice"
+	if err := wr.Update[*Task](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	wt := wr.Watch[*Task](w, ctx, nil, 0, wr.WithInitialEvents())
+	defer wt.Stop()
+	if err := wr.Delete[*Task](w, ctx, nil, nil, b); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	events := receive(t, wt, 3)
+	checkEvents(t, events, []wantEvent{
+		{event.EventActionCreate, 3, 1, 0, "a"},
+		{event.EventActionCreate, 2, 2, 0, "b"},
+		{event.EventActionDelete, 4, 2, 2, "b"},
+	})
+	if events[0].CreatedAt.IsZero() || events[1].CreatedAt.IsZero() {
+		t.Error("initial events have no creation time")
+	}
+}
+
+func TestMemoryListPage(t *testing.T) {
+	w := newMemoryRelay(t)
+	ctx := context.Background()
+
+	tasks := []*Task{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+	if err := wr.Create[*Task](w, ctx, nil, nil, tasks...); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := wr.Delete[*Task](w, ctx, nil, nil, tasks[1], tasks[2]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	var names []string
+	opts := wr.ListOptions{Limit: 1}
+	for {
+		page, err := wr.ListPage[*Task](w, ctx, nil, opts)
+		if err != nil {
+			t.Fatalf("ListPage: %v", err)
+		}
+		for _, item := range page.Items {
+			names = append(names, item.Name)
+		}
+		if page.Continue == "" {
+			break
+		}
+		opts.Continue = page.Continue
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "d" {
+		t.Fatalf("listed %v, want [a d]", names)
+	}
+}
+
+// failingStore is a Store whose reads of the log fail while fail is set.
+type failingStore struct {
+	sqllog.Store
+	fail atomic.Bool
+}
+
+var errUnavailable = errors.New("connection refused")
+
+func (s *failingStore) After(ctx context.Context, resourceName string, revision uint64, limit int64) (sqllog.Rows, error) {
+	if s.fail.Load() {
+		return nil, errUnavailable
+	}
+	return s.Store.After(ctx, resourceName, revision, limit)
+}
+
+func TestMemoryWatchDatabaseError(t *testing.T) {
+	store := &failingStore{Store: memory.New()}
+	w := newStoreRelay(t, store, wr.WithLogger(logging.Discard()))
+	ctx := context.Background()
+
+	wt := wr.Watch[*Task](w, ctx, nil, 0)
+	defer wt.Stop()
+	store.fail.Store(true)
+
+	select {
+	case _, ok := <-wt.ResultChan():
+		if ok {
+			t.Fatal("received events while the database fails")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not end while the database fails")
+	}
+	if err := wt.Err(); !errors.Is(err, wr.ErrDatabase) || !errors.Is(err, errUnavailable) {
+		t.Fatalf("watch ended with %v, want a DatabaseError", err)
+	}
+}
+
+func TestMemoryWatchResumesAfterDatabaseError(t *testing.T) {
+	store := &failingStore{Store: memory.New()}
+	w := newStoreRelay(t, store, wr.WithLogger(logging.Discard()))
+	ctx := context.Background()
+
+	wt := wr.Watch[*Task](w, ctx, nil, 0, wr.WithResume(10*time.Millisecond, 50*time.Millisecond))
+	defer wt.Stop()
+
+	// Fail long enough for the poller to give up, then recover.
+	store.fail.Store(true)
+	a := &Task{Name: "a"}
+	if err := wr.Create[*Task](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	store.fail.Store(false)
+
+	checkEvents(t, receive(t, wt, 1), []wantEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+	})
+}
+
+func TestMemoryWatchResumesOutOfOrderCommit(t *testing.T) {
+	store := &failingStore{Store: memory.New()}
+	w := newStoreRelay(t, store, wr.WithLogger(logging.Discard()))
+	ctx := context.Background()
+
+	wt := wr.Watch[*Task](w, ctx, nil, 0, wr.WithResume(10*time.Millisecond, 50*time.Millisecond))
+	defer wt.Stop()
+
+	// Revision 2 commits while revision 1 is still running and the poller
+	// fails long enough for the watch to resume.
+	store.fail.Store(true)
+	release := make(chan struct{})
+	done := createHeld(t, w, &Task{Name: "a"}, release)
+	if err := wr.Create[*Task](w, ctx, nil, nil, &Task{Name: "b"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// The watch resumes while revision 1 is missing from the log.
+	store.fail.Store(false)
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	checkEvents(t, receive(t, wt, 2), []wantEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+		{event.EventActionCreate, 2, 2, 0, "b"},
+	})
+}
+
+func TestMemoryWatchSpillCatchesUp(t *testing.T) {
+	w := newMemoryRelay(t)
+	ctx := context.Background()
+
+	wt := wr.Watch[*Task](w, ctx, nil, 0, wr.WithBackpressure(wr.SpillToRelist), wr.WithBufferSize(1))
+	defer wt.Stop()
+
+	// The consumer falls behind while the tasks are created one by one.
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		if err := wr.Create[*Task](w, ctx, nil, nil, &Task{Name: name}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	checkEvents(t, receive(t, wt, 5), []wantEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+		{event.EventActionCreate, 2, 2, 0, "b"},
+		{event.EventActionCreate, 3, 3, 0, "c"},
+		{event.EventActionCreate, 4, 4, 0, "d"},
+		{event.EventActionCreate, 5, 5, 0, "e"},
+	})
+}
+
+func TestMemoryNotStarted(t *testing.T) {
+	w, err := wr.NewWatchRelayWithStore(memory.New(), wr.WithLogger(logging.Discard()))
+	if err != nil {
+		t.Fatalf("NewWatchRelayWithStore: %v", err)
+	}
+	if err := wr.RegisterResource[*Task](w); err != nil {
+		t.Fatalf("RegisterResource: %v", err)
+	}
+	ctx := context.Background()
+
+	if _, _, err := wr.List[*Task](w, ctx, nil); !errors.Is(err, wr.ErrNotStarted) {
+		t.Errorf("List returned %v, want ErrNotStarted", err)
+	}
+	wt := wr.Watch[*Task](w, ctx, nil, 0)
+	for range wt.ResultChan() {
+	}
+	if err := wt.Err(); !errors.Is(err, wr.ErrNotStarted) {
+		t.Errorf("watch ended with %v, want ErrNotStarted", err)
+	}
+}
+
+func TestSQLitePatch(t *testing.T) {
+	db, w := newSQLiteRelay(t)
+	ctx := context.Background()
+
+	a := &Item{Name: "a", Owner: "alice"}
+	if err := wr.Create[*Item](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// Only the owner is written; the name is left as stored.
+	patch := &Item{ID: a.ID, Owner: "bob"}
+	patch.SetResourceVersion(a.ResourceVersion)
+	if err := wr.Patch[*Item](w, ctx, nil, nil, patch); err != nil {
+		t.Fatalf("Patch: %v", err)
+	}
+	if patch.Name != "a" || patch.Owner != "bob" || patch.ResourceVersion != 2 {
+		t.Errorf("patched item %+v, want a owned by bob at version 2", patch)
+	}
+
+	checkLog(t, w, []wantItemEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+		{event.EventActionUpdate, 2, 1, 1, "a"},
+	})
+	if got := versions(t, db); got["a"] != 2 {
+		t.Errorf("rows at versions %v, want a at 2", got)
+	}
+}
+
+func TestSQLiteSoftDelete(t *testing.T) {
+	db, w := newSQLiteRelay(t)
+	ctx := context.Background()
+
+	a, b := &Item{Name: "a"}, &Item{Name: "b"}
+	if err := wr.Create[*Item](w, ctx, nil, nil, a, b); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := wr.Delete[*Item](w, ctx, nil, nil, a); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if !a.DeletedAt.Valid || a.ResourceVersion != 3 {
+		t.Errorf("deleted item %+v, want it soft deleted at version 3", a)
+	}
+
+	// Like with the plugin, the soft deleted row is kept at the revision of
+	// its delete.
+	checkLog(t, w, []wantItemEvent{
+		{event.EventActionCreate, 1, 1, 0, "a"},
+		{event.EventActionCreate, 2, 2, 0, "b"},
+		{event.EventActionDelete, 3, 1, 1, "a"},
+	})
+	if got := versions(t, db); got["a"] != 3 || got["b"] != 2 {
+		t.Errorf("rows at versions %v, want a at 3 and b at 2", got)
+	}
+	var n int64
+	if err := db.Model(&Item{}).Count(&n).Error; err != nil || n != 1 {
+		t.Errorf("counted %d items, %v, want 1", n, err)
+	}
+}
+
+func TestSQLiteTableAllocator(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "watchrelay.db")
+	_, w1 := startSQLiteRelay(t, file, wr.WithRevisionAllocator(wr.NewTableAllocator))
+	_, w2 := startSQLiteRelay(t, file, wr.WithRevisionAllocator(wr.NewTableAllocator))
+	ctx := context.Background()
+
+	wt := wr.Watch[*Item](w1, ctx, nil, 0)
+	defer wt.Stop()
+
+	// Both relays write concurrently to the shared log.
+	const n = 20
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		for j, w := range []*wr.WatchRelay{w1, w2} {
+			item := &Item{Name: fmt.Sprintf("%d-%d", j, i)}
+			go func(w *wr.WatchRelay) {
+				errs <- wr.Create[*Item](w, ctx, nil, nil, item)
+			}(w)
+		}
+	}
+	for i := 0; i < 2*n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	// The revisions are unique and the watch of either relay gets them all
+	// in order.
+	events := receive(t, wt, 2*n)
+	names := make(map[string]bool, len(events))
+	for i, e := range events {
+		if e.Revision != uint64(i+1) {
+			t.Fatalf("event %d at revision %d, want %d", i, e.Revision, i+1)
+		}
+		names[e.Value.Name] = true
+	}
+	if len(names) != 2*n {
+		t.Errorf("watched %d items, want %d", len(names), 2*n)
+	}
+}
+
+// fakeTracer records the spans it starts, identified by their names and the
+// names of their parents.
+type fakeTracer struct {
+	mu    sync.Mutex
+	spans []string
+}
+
+type spanKey struct{}
+
+type fakeSpan struct {
+	id string
+}
+
+func (s *fakeSpan) SetAttributes(attrs ...tracing.Attribute) {}
+func (s *fakeSpan) RecordError(error)                        {}
+func (s *fakeSpan) End()                                     {}
+
+func (tr *fakeTracer) Start(ctx context.Context, name string, attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+	id := name
+	if parent, ok := ctx.Value(spanKey{}).(*fakeSpan); ok {
+		id = parent.id + "/" + name
+	}
+	span := &fakeSpan{id: id}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.spans = append(tr.spans, id)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (tr *fakeTracer) started(id string) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, s := range tr.spans {
+		if s == id {
+			return true
+		}
+	}
+	return false
+}
+
+// fakePropagator propagates the id of the span of a context.
+type fakePropagator struct{}
+
+func (fakePropagator) Inject(ctx context.Context, carrier tracing.Carrier) {
+	if span, ok := ctx.Value(spanKey{}).(*fakeSpan); ok {
+		carrier.Set("span", span.id)
+	}
+}
+
+func (fakePropagator) Extract(ctx context.Context, carrier tracing.Carrier) context.Context {
+	if id := carrier.Get("span"); id != "" {
+		return context.WithValue(ctx, spanKey{}, &fakeSpan{id: id})
+	}
+	return ctx
+}
+
+func TestMemoryWatchTraceContext(t *testing.T) {
+	tracer := &fakeTracer{}
+	w := newMemoryRelay(t, wr.WithTracer(tracer), wr.WithPropagator(fakePropagator{}))
+
+	wt := wr.Watch[*Task](w, context.Background(), nil, 0)
+	defer wt.Stop()
+
+	ctx, span := tracer.Start(context.Background(), "request")
+	defer span.End()
+	if err := wr.Create[*Task](w, ctx, nil, nil, &Task{Name: "a"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// The event carries the context of the span of the write, so that the
+	// watcher continues the trace of the request.
+	e := receive(t, wt, 1)[0]
+	if got := e.TraceContext.Get("span"); got != "request/watchrelay.Create" {
+		t.Errorf("event has trace context %v, want the span request/watchrelay.Create", e.TraceContext)
+	}
+	linked, _ := tracer.Start(fakePropagator{}.Extract(context.Background(), e.TraceContext), "reconcile")
+	if got := linked.Value(spanKey{}).(*fakeSpan).id; got != "request/watchrelay.Create/reconcile" {
+		t.Errorf("span started from the event is %s, want request/watchrelay.Create/reconcile", got)
+	}
+
+	// The queries of the log and the polls are traced as well.
+	for _, id := range []string{"request/watchrelay.Create/watchrelay.dialect.Append", "watchrelay.poll"} {
+		if !tracer.started(id) {
+			t.Errorf("span %s not started", id)
+		}
+	}
+}
+
+func TestMemoryWatchNoTraceContext(t *testing.T) {
+	// Without a propagator, events carry no trace context.
+	w := newMemoryRelay(t, wr.WithTracer(&fakeTracer{}))
+
+	wt := wr.Watch[*Task](w, context.Background(), nil, 0)
+	defer wt.Stop()
+	if err := wr.Create[*Task](w, context.Background(), nil, nil, &Task{Name: "a"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if e := receive(t, wt, 1)[0]; len(e.TraceContext) != 0 {
+		t.Errorf("event has trace context %v, want none", e.TraceContext)
+	}
+}